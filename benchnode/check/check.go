@@ -23,6 +23,7 @@ import (
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"sort"
 	"strings"
 	"time"
 )
@@ -40,13 +41,16 @@ type Result struct {
 	RT    int64    // Run Time of the check, nanoseconds
 	Errs  string   // Error string returned by libraries
 	S     []string // Results of the run (e.g., HTTP headers)
+	Delay int64    // Time the check waited to be run, nanoseconds
+	Seq   int64    // Sequence number on the node, acknowledged by server
+	Skew  int64    // Clock skew when sent, see lib/conn
 }
 
 // String dumps all fields of Result on several lines for easier debugging.
 func (r *Result) String() string {
-	return fmt.Sprintf("%q\njob: %v\nflags: %v\nerr: %v\nstart: %v\nelapsed: %d.%06d s\n",
+	return fmt.Sprintf("%q\njob: %v\nflags: %v\nerr: %v\nstart: %v\nelapsed: %d.%06d s\ndelay: %d.%06d s\n",
 		r.S, r.JobId, r.Flags, r.Errs, r.Start,
-		r.RT/1e9, r.RT%1e9/1e3)
+		r.RT/1e9, r.RT%1e9/1e3, r.Delay/1e9, r.Delay%1e9/1e3)
 }
 
 var (
@@ -170,6 +174,26 @@ func checkDNSLookup(m checkMap, s []string, dryrun bool) *Result {
 	return &Result{S: a}
 }
 
+// names appends to a the paths of checks in m, joined with dots.
+func (m checkMap) names(a []string, prefix string) []string {
+	for k, v := range m {
+		if v.m != nil {
+			a = v.m.names(a, prefix+k+".")
+		} else {
+			a = append(a, prefix+k)
+		}
+	}
+	return a
+}
+
+// Names returns the sorted list of supported checks, such as "dns"
+// or "http.get".
+func Names() []string {
+	a := checks.names(nil, "")
+	sort.Strings(a)
+	return a
+}
+
 // IsValid validates the check represented by s without actually running it.
 func IsValid(s []string) bool {
 	return runCheck(checks, s, true).Flags&ResFail == 0
@@ -17,6 +17,7 @@
 package main
 
 import (
+	"database/sql"
 	"errors"
 	"fmt"
 	_ "github.com/mattn/go-sqlite3"
@@ -33,45 +34,113 @@ var dbc *stdb.DB
 // database schema:
 // table jobs:
 //     id     job id
-//     period period in seconds
+//     period period in seconds, 0 for one-shot jobs
 //     start  offset in seconds; jobs run at Unix time N*period+start
+//            (one-shot jobs run at Unix time start, or at once if 0)
 //     cmd    the check to run (space-separated string)
+//     overrun what to do if the previous run is late (see sched)
+//     done   1 if a one-shot job has run
 // table results:
+//     seq      sequence number, never reused
 //     id       job id that generated the result
 //     start    time when the run started, nanoseconds since Unix epoch
 //     duration overall time for this run, in nanoseconds
 //     flags    see constants below
 //     err      error, if any
 //     result   encoded ("%+q") string array of results
+//     delay    time the run waited to be started, in nanoseconds
+// table keys:
+//     key      network key received from the server
+//     conf     network key from the config file it replaces
+// table server:
+//     id       always 1
+//     addr     server that last succeeded, as host or host:port
+// table schema_version:
+//     version  number of migrations below applied
 const (
 	// SHOUT SQL IN CAPITAL LETTERS SO THE DATABASE WILL HEAR YA!!!
-	dbCreate1          = "CREATE TABLE IF NOT EXISTS jobs (id INTEGER PRIMARY KEY, period INTEGER, start INTEGER, cmd TEXT)"
-	dbCreate2          = "CREATE TABLE IF NOT EXISTS results (id INTEGER, start INTEGER, duration INTEGER, flags INTEGER, err TEXT, result TEXT)"
-	dbInsertJob        = "INSERT OR REPLACE INTO jobs (id, period, start, cmd) VALUES (?, ?, ?, ?)"
-	dbSelectJobs       = "SELECT id, period, start, cmd FROM jobs"
+	dbCreate1          = "CREATE TABLE IF NOT EXISTS jobs (id INTEGER PRIMARY KEY, period INTEGER, start INTEGER, cmd TEXT, overrun INTEGER, done INTEGER DEFAULT 0)"
+	dbCreate2          = "CREATE TABLE IF NOT EXISTS results (seq INTEGER PRIMARY KEY AUTOINCREMENT, id INTEGER, start INTEGER, duration INTEGER, flags INTEGER, err TEXT, result TEXT, delay INTEGER)"
+	dbInsertJob        = "INSERT OR REPLACE INTO jobs (id, period, start, cmd, overrun) VALUES (?, ?, ?, ?, ?)"
+	dbSelectJobs       = "SELECT id, period, start, cmd, overrun, done FROM jobs"
 	dbDeleteJob        = "DELETE FROM jobs WHERE id = ?"
-	dbInsertResult     = "INSERT OR REPLACE INTO results (id, start, duration, flags, err, result) VALUES (?, ?, ?, ?, ?, ?)"
-	dbSelectResults    = "SELECT id, start, duration, flags, err, result FROM results WHERE start >= ?"
+	dbJobDone          = "UPDATE jobs SET done = 1 WHERE id = ?"
+	dbInsertResult     = "INSERT OR REPLACE INTO results (id, start, duration, flags, err, result, delay) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	dbSelectResults    = "SELECT seq, id, start, duration, flags, err, result, delay FROM results WHERE start >= ?"
+	dbSelectNewResults = "SELECT seq, id, start, duration, flags, err, result, delay FROM results WHERE seq > ? ORDER BY seq LIMIT ?"
 	dbDeleteResults    = "DELETE FROM results WHERE start < ?"
+	dbDeleteAcked      = "DELETE FROM results WHERE seq <= ?"
 	dbDeleteJobResults = "DELETE FROM results WHERE id = ?"
+	dbCreate3          = "CREATE TABLE IF NOT EXISTS keys (key BLOB, conf BLOB)"
+	dbSelectKey        = "SELECT key FROM keys WHERE conf = ? ORDER BY rowid DESC LIMIT 1"
+	dbInsertKey        = "INSERT INTO keys (key, conf) VALUES (?, ?)"
+	dbDeleteKeys       = "DELETE FROM keys WHERE rowid < ?"
+	dbCreate4          = "CREATE TABLE IF NOT EXISTS server (id INTEGER PRIMARY KEY, addr TEXT)"
+	dbSelectServer     = "SELECT addr FROM server WHERE id = 1"
+	dbInsertServer     = "INSERT OR REPLACE INTO server (id, addr) VALUES (1, ?)"
 )
 
-func dbOpen() error {
-	var err error
-	dbc, err = stdb.Open("sqlite3", dbfile)
-	if err != nil {
+// columns added to tables created by versions before schema migrations
+var dbAddColumns = []string{
+	"ALTER TABLE jobs ADD COLUMN overrun INTEGER DEFAULT 0",
+	"ALTER TABLE jobs ADD COLUMN done INTEGER DEFAULT 0",
+	"ALTER TABLE results ADD COLUMN delay INTEGER DEFAULT 0",
+}
+
+// statements rebuilding table results without seq, which can't be
+// added by ALTER TABLE as it's the primary key
+var dbAddSeq = []string{
+	"ALTER TABLE results RENAME TO results_old",
+	dbCreate2,
+	"INSERT INTO results (id, start, duration, flags, err, result, delay) SELECT id, start, duration, flags, err, result, delay FROM results_old ORDER BY rowid",
+	"DROP TABLE results_old",
+}
+
+const dbHasSeq = "SELECT count(*) FROM pragma_table_info('results') WHERE name = 'seq'"
+
+// migrations upgrade the schema, in order; existing ones must never
+// change.
+var migrations = []stdb.Migration{
+	{
+		Desc:  "create tables, upgrade unversioned database",
+		Stmts: []string{dbCreate1, dbCreate2, dbCreate3, dbCreate4},
+		Func:  upgradeUnversioned,
+	},
+}
+
+// upgradeUnversioned brings tables created by versions before schema
+// migrations, which may be missing columns added since, up to date.
+func upgradeUnversioned(tx *stdb.Tx) error {
+	for _, v := range dbAddColumns {
+		_, err := tx.Exec(v)
+		if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			return err
+		}
+	}
+	var n int
+	if err := tx.QueryRow(dbHasSeq).Scan(&n); err != nil || n != 0 {
 		return err
 	}
-	for _, v := range []string{dbCreate1, dbCreate2} {
-		if _, err = dbc.Exec(v); err != nil {
+	for _, v := range dbAddSeq {
+		if _, err := tx.Exec(v); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+func dbOpen() error {
+	var err error
+	dbc, err = stdb.Open("sqlite3", dbfile)
+	if err != nil {
+		return err
+	}
+	return dbc.Migrate(migrations, log.Info)
+}
+
 func insertJob(j *jobDesc) error {
-	_, err := dbc.Exec(dbInsertJob, j.Id, j.Period, j.Start, strings.Join(j.Check, " "))
+	_, err := dbc.Exec(dbInsertJob, j.Id, j.Period, j.Start,
+		strings.Join(j.Check, " "), j.Overrun)
 	return err
 }
 
@@ -80,34 +149,34 @@ func deleteJob(id int) error {
 	return err
 }
 
-func replaceJobs(oldjobs, newjobs jobList) error {
+func markJobDone(id uint64) error {
+	_, err := dbc.Exec(dbJobDone, id)
+	return err
+}
+
+// replaceJobs deletes jobs del and inserts jobs ins.
+func replaceJobs(del []uint64, ins jobList) error {
 	tx, err := dbc.Begin()
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback() // nop if committed
 	// Maybe we should prepare statements instead of Exec()ing?
-	// Delete running jobs
-	for _, v := range oldjobs {
-		if v.s != nil {
-			if _, err := tx.Exec(dbDeleteJob, v.Id); err != nil {
-				return err
-			}
-			/*
-				if _, err := tx.Exec(dbDeleteJobResults, v.Id); err != nil {
-					return err
-				}
-			*/
+	for _, id := range del {
+		if _, err := tx.Exec(dbDeleteJob, id); err != nil {
+			return err
 		}
-	}
-	// Insert idle jobs
-	for _, v := range newjobs {
-		if v.s == nil {
-			_, err = tx.Exec(dbInsertJob, v.Id, v.Period, v.Start,
-				strings.Join(v.Check, " "))
-			if err != nil {
+		/*
+			if _, err := tx.Exec(dbDeleteJobResults, id); err != nil {
 				return err
 			}
+		*/
+	}
+	for _, v := range ins {
+		_, err = tx.Exec(dbInsertJob, v.Id, v.Period, v.Start,
+			strings.Join(v.Check, " "), v.Overrun)
+		if err != nil {
+			return err
 		}
 	}
 	return tx.Commit()
@@ -123,7 +192,8 @@ func loadJobs() error {
 	for rows.Next() {
 		var j jobDesc
 		var s string
-		if err := rows.Scan(&j.Id, &j.Period, &j.Start, &s); err != nil {
+		if err := rows.Scan(&j.Id, &j.Period, &j.Start, &s,
+			&j.Overrun, &j.done); err != nil {
 			return err
 		}
 		j.Check = strings.Fields(s)
@@ -137,9 +207,54 @@ func loadJobs() error {
 	return nil
 }
 
+// loadKey returns the newest network key received from the server
+// to replace conf, the key from the config file, or conf if none.
+func loadKey(conf []byte) ([]byte, error) {
+	var key []byte
+	err := dbc.QueryRow(dbSelectKey, conf).Scan(&key)
+	switch {
+	case err == sql.ErrNoRows:
+		return conf, nil
+	case err != nil:
+		return nil, err
+	}
+	return key, nil
+}
+
+// saveKey stores key received from the server to replace conf and
+// forgets older keys.
+func saveKey(key, conf []byte) error {
+	r, err := dbc.Exec(dbInsertKey, key, conf)
+	if err != nil {
+		return err
+	}
+	id, err := r.LastInsertId()
+	if err != nil {
+		return err
+	}
+	_, err = dbc.Exec(dbDeleteKeys, id)
+	return err
+}
+
+// loadServer returns the server that last succeeded, "" if none.
+func loadServer() (string, error) {
+	var addr string
+	err := dbc.QueryRow(dbSelectServer).Scan(&addr)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return addr, err
+}
+
+// saveServer remembers addr as the server that last succeeded.
+func saveServer(addr string) error {
+	_, err := dbc.Exec(dbInsertServer, addr)
+	return err
+}
+
 func insertResult(r *check.Result) error {
 	_, err := dbc.Exec(dbInsertResult, r.JobId, r.Start, r.RT, r.Flags,
-		r.Errs, fmt.Sprintf("%+q", r.S))
+		r.Errs, fmt.Sprintf("%+q", r.S), r.Delay)
 	return err
 }
 
@@ -195,29 +310,63 @@ func parseStringArray(s string) ([]string, error) {
 	return a, nil
 }
 
-func loadResults(from uint64) ([]*check.Result, error) {
-	rows, err := dbc.Query(dbSelectResults, from)
-	if err != nil {
-		return nil, err
-	}
+// scanResults returns results from rows, with the highest seq.
+func scanResults(rows *stdb.Rows) ([]*check.Result, int64, error) {
 	defer rows.Close()
+	var last int64
 	ra := make([]*check.Result, 0, 16)
 	for rows.Next() {
 		var s string
 		r := &check.Result{}
-		err = rows.Scan(&r.JobId, &r.Start, &r.RT, &r.Flags, &r.Errs, &s)
+		err := rows.Scan(&r.Seq, &r.JobId, &r.Start, &r.RT, &r.Flags,
+			&r.Errs, &s, &r.Delay)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 		if r.S, err = parseStringArray(s); err != nil {
-			return nil, err
+			return nil, 0, err
+		}
+		if r.Seq > last {
+			last = r.Seq
 		}
 		ra = append(ra, r)
 	}
-	return ra, nil
+	return ra, last, nil
+}
+
+// loadResults loads results of runs started at or after from.
+func loadResults(from uint64) ([]*check.Result, int64, error) {
+	rows, err := dbc.Query(dbSelectResults, from)
+	if err != nil {
+		return nil, 0, err
+	}
+	return scanResults(rows)
+}
+
+// loadResultsAfter loads up to max results stored after the one with
+// seq last, or all of them if max isn't positive.
+func loadResultsAfter(last int64, max int) ([]*check.Result, int64, error) {
+	if max <= 0 {
+		max = -1 // no limit
+	}
+	rows, err := dbc.Query(dbSelectNewResults, last, max)
+	if err != nil {
+		return nil, 0, err
+	}
+	ra, n, err := scanResults(rows)
+	if n < last {
+		n = last
+	}
+	return ra, n, err
 }
 
 func deleteResults(till uint64) error {
 	_, err := dbc.Exec(dbDeleteResults, till)
 	return err
 }
+
+// deleteAcked deletes results up to seq, acknowledged by the server.
+func deleteAcked(seq int64) error {
+	_, err := dbc.Exec(dbDeleteAcked, seq)
+	return err
+}
@@ -0,0 +1,84 @@
+// Benchnet
+//
+// Copyright 2012 Vadim Vygonets
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"github.com/unixdj/benchnet/lib/stdb"
+	"path/filepath"
+	"testing"
+)
+
+// schema and data of a database created by the first version
+var baselineDB = []string{
+	"CREATE TABLE jobs (id INTEGER PRIMARY KEY, period INTEGER, start INTEGER, cmd TEXT)",
+	"CREATE TABLE results (id INTEGER, start INTEGER, duration INTEGER, flags INTEGER, err TEXT, result TEXT)",
+	"INSERT INTO jobs VALUES (9, 60, 0, 'dns example.com')",
+	`INSERT INTO results VALUES (9, 100, 1000, 0, '', '["a"]')`,
+	`INSERT INTO results VALUES (9, 200, 1000, 1, 'oops', '[]')`,
+}
+
+func TestMigrateBaseline(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "benchnode.db")
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range baselineDB {
+		if _, err = db.Exec(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+	if dbc, err = stdb.Open("sqlite3", file); err != nil {
+		t.Fatal(err)
+	}
+	defer dbc.Close()
+	nolog := func(string) error { return nil }
+	for i := 0; i < 2; i++ { // migrate, then nothing to do
+		if err = dbc.Migrate(migrations, nolog); err != nil {
+			t.Fatalf("migrate %d: %v", i, err)
+		}
+	}
+	var (
+		j jobDesc
+		s string
+	)
+	err = dbc.QueryRow(dbSelectJobs).Scan(&j.Id, &j.Period, &j.Start, &s,
+		&j.Overrun, &j.done)
+	if err != nil || j.Id != 9 || j.Overrun != 0 || j.done {
+		t.Errorf("job %+v, %v, want job 9 not done", j, err)
+	}
+	ra, last, err := loadResultsAfter(0, 0)
+	if err != nil || len(ra) != 2 || last != 2 {
+		t.Fatalf("got %d results, last %d, %v, want 2, 2",
+			len(ra), last, err)
+	}
+	if ra[0].Seq != 1 || ra[0].S[0] != "a" || ra[1].Errs != "oops" {
+		t.Errorf("results %+v, %+v", ra[0], ra[1])
+	}
+	if err = deleteAcked(2); err != nil {
+		t.Fatal(err)
+	}
+	if err = insertResult(ra[1]); err != nil {
+		t.Fatal(err)
+	}
+	if _, last, err = loadResultsAfter(0, 0); last != 3 {
+		t.Errorf("seq after insert %d, %v, want 3 (never reused)",
+			last, err)
+	}
+}
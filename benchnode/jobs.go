@@ -25,16 +25,23 @@ import (
 	"time"
 )
 
+// Jobs with zero Period are one-shot jobs.  They run once at Unix
+// time Start, or as soon as received if Start is zero or has passed.
 type jobDesc struct {
 	Id            uint64
 	Period, Start int
 	Check         []string
+	Overrun       int // sched.Skip, sched.Queue or sched.Concurrent
 	s             *sched.Sched
+	done          bool // one-shot job has run (as of loading from db)
 }
 
 type jobList []jobDesc
 
-var jobs jobList
+var (
+	jobs jobList
+	pool *sched.Pool // limits concurrent checks
+)
 
 // util
 
@@ -79,36 +86,61 @@ func killJob(id uint64) bool {
 	if !ok {
 		return false
 	}
-	jobs[i].s.Stop()
-	log.Debug(fmt.Sprintf("killed job %d", jobs[i].Id))
+	if jobs[i].s != nil {
+		jobs[i].s.Stop()
+		log.Debug(fmt.Sprintf("killed job %d", jobs[i].Id))
+	}
 	jobs = append(jobs[0:i], jobs[i+1:]...) // delete from list
 	return true
 }
 
 func scheduleJob(j *jobDesc) {
-	j.s = sched.New(int2dur(j.Period), int2dur(j.Start), func() {
-		r := check.Run(j.Id, j.Check)
+	id, c, once := j.Id, j.Check, j.Period == 0
+	f := func(due time.Time) {
+		start := clk.Now()
+		r := check.Run(id, c)
+		r.Start, r.Delay = start.UnixNano(), int64(start.Sub(due))
 		if err := insertResult(r); err != nil {
 			log.Err(err.Error())
 		}
-	})
-	log.Debug(fmt.Sprintf("start job %d: period %d, start %d, check %v",
-		j.Id, j.Period, j.Start, j.Check))
+		client.Notify()
+		if once {
+			if err := markJobDone(id); err != nil {
+				log.Err(err.Error())
+			}
+		}
+	}
+	if once {
+		j.s = pool.Once(time.Unix(int64(j.Start), 0), f)
+		log.Debug(fmt.Sprintf("start one-shot job %d: at %d, check %v",
+			j.Id, j.Start, j.Check))
+		return
+	}
+	j.s = pool.New(int2dur(j.Period), int2dur(j.Start), j.Overrun, f)
+	log.Debug(fmt.Sprintf("start job %d: period %d, start %d, overrun %d, check %v",
+		j.Id, j.Period, j.Start, j.Overrun, j.Check))
+}
+
+// validJob checks that j can be scheduled.
+func validJob(j *jobDesc) bool {
+	return j.Period >= 0 && check.IsValid(j.Check)
 }
 
 func addJob(j *jobDesc, start bool) bool {
-	if !check.IsValid(j.Check) {
+	if !validJob(j) {
 		return false
 	}
 	i, found := findJob(j.Id)
 	if found {
-		jobs[i].s.Stop()
-		log.Debug(fmt.Sprintf("killed job %d", j.Id))
+		if jobs[i].s != nil {
+			jobs[i].s.Stop()
+			log.Debug(fmt.Sprintf("killed job %d", j.Id))
+		}
 		jobs[i] = *j
 	} else {
 		jobs = append(jobs[:i], append(jobList{*j}, jobs[i:]...)...)
 	}
-	if start {
+	if start && !j.done {
 		scheduleJob(&jobs[i])
 	}
 	return true
@@ -116,7 +148,7 @@ func addJob(j *jobDesc, start bool) bool {
 
 func startJobs() {
 	for i := range jobs {
-		if jobs[i].s == nil {
+		if jobs[i].s == nil && !jobs[i].done {
 			scheduleJob(&jobs[i])
 		}
 	}
@@ -124,7 +156,7 @@ func startJobs() {
 
 func jobsEqual(a, b *jobDesc) bool {
 	if a.Id != b.Id || a.Period != b.Period || a.Start != b.Start ||
-		len(a.Check) != len(b.Check) {
+		a.Overrun != b.Overrun || len(a.Check) != len(b.Check) {
 		return false
 	}
 	for i, v := range a.Check {
@@ -135,49 +167,48 @@ func jobsEqual(a, b *jobDesc) bool {
 	return true
 }
 
-func mergeJobs(newjobs jobList) (status []bool, err error) {
+// mergeJobs replaces the job list with newjobs.  Jobs that haven't
+// changed keep running undisturbed, so that one-shot jobs don't run
+// again each time the server sends them.
+func mergeJobs(newjobs jobList) error {
 	sort.Sort(newjobs)
-	updated := false
-	status = make([]bool, len(newjobs))
-	i, j := 0, 0
-	for i < len(jobs) && j < len(newjobs) {
-		switch {
-		case jobs[i].Id == jobs[j].Id:
-			if jobsEqual(&jobs[i], &newjobs[j]) {
-				newjobs[j].s, jobs[i].s = jobs[i].s, nil
-			} else {
-				status[j] = check.IsValid(newjobs[j].Check)
-				updated = true
+	var (
+		del  []uint64 // jobs to delete from db
+		ins  jobList  // jobs to insert into db
+		keep = make(jobList, 0, len(newjobs))
+		i    int
+	)
+	for _, v := range newjobs {
+		for ; i < len(jobs) && jobs[i].Id < v.Id; i++ {
+			del = append(del, jobs[i].Id)
+		}
+		if i < len(jobs) && jobs[i].Id == v.Id {
+			if jobsEqual(&jobs[i], &v) {
+				v.s, v.done, jobs[i].s = jobs[i].s, jobs[i].done, nil
+				keep = append(keep, v)
+				i++
+				continue
 			}
+			del = append(del, jobs[i].Id)
 			i++
-			j++
-		case jobs[i].Id < newjobs[j].Id:
-			i++
-			updated = true
-		default:
-			status[j] = check.IsValid(newjobs[j].Check)
-			j++
-			updated = true
 		}
-	}
-	if i < len(jobs) || j < len(newjobs) {
-		updated = true
-	}
-	j = 0
-	for _, v := range status {
-		if v {
-			j++
-		} else {
-			newjobs = append(newjobs[:j], newjobs[j+1:]...)
+		if !validJob(&v) {
+			log.Notice(fmt.Sprintf("invalid job %d: %v", v.Id, v.Check))
+			continue
 		}
+		ins = append(ins, v)
+		keep = append(keep, v)
+	}
+	for ; i < len(jobs); i++ {
+		del = append(del, jobs[i].Id)
 	}
-	if updated {
-		if err = replaceJobs(jobs, newjobs); err != nil {
-			return
+	if len(del) != 0 || len(ins) != 0 {
+		if err := replaceJobs(del, ins); err != nil {
+			return err
 		}
 	}
 	killJobs()
-	jobs = newjobs
+	jobs = keep
 	startJobs()
-	return
+	return nil
 }
@@ -18,26 +18,50 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
 	"errors"
+	"flag"
 	"fmt"
+	"github.com/unixdj/benchnet/benchnode/sched"
+	"github.com/unixdj/benchnet/lib/clock"
+	"github.com/unixdj/benchnet/lib/conn"
 	"github.com/unixdj/conf"
 	"log/syslog"
-	"math/rand"
+	mrand "math/rand"
 	"os"
 	"os/signal"
 	"regexp"
+	"strings"
 	"syscall"
 	"time"
 )
 
 var (
 	log              *syslog.Writer
+	clk              = clock.Real
 	conffile         = "benchnode.conf"
 	dbfile           = "benchnode.db"
-	serverAddr       = "klaipeda.startunit.com"
+	servers          = serverList{groups: [][]server{{{"klaipeda.startunit.com", 1}}}}
+	lastServer       string // server that last succeeded
 	clientId, nodeId uint64
 	networkKey       []byte
+	confKey          []byte             // networkKey from config file
+	privKey          ed25519.PrivateKey // use instead of networkKey
+	serverKey        ed25519.PublicKey  // required with privKey
+	serverCert       []byte             // SHA-256 fingerprint; use TLS if set
+	proxy            conn.Proxy         // for connecting to server if set
+	websocket        bool               // connect over WebSocket on 443
+	maxChecks        uint64             // concurrent checks; 0 for unlimited
+	persistent       bool               // stay connected to server
 	netKeyRE         = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+
+	// connection timing, see benchnode.conf
+	reconnectTime = time.Hour
+	reconnectFuzz = time.Minute * 10
+	retryTime     = time.Minute * 10
+	retryFuzz     = time.Minute * 2
+	retryMax      = time.Hour * 2
 )
 
 type netKeyValue []byte
@@ -52,20 +76,91 @@ func (key *netKeyValue) Set(s string) error {
 
 //func (key *netKeyValue) String() string { return fmt.Sprintf("%x", *key) }
 
+type privKeyValue ed25519.PrivateKey
+
+func (key *privKeyValue) Set(s string) error {
+	var seed []byte
+	if !netKeyRE.MatchString(s) {
+		return errors.New("invalid private key (must be 64 hexadecimal digits)")
+	}
+	fmt.Sscanf(s, "%x", &seed) // will succeed
+	*key = privKeyValue(ed25519.NewKeyFromSeed(seed))
+	return nil
+}
+
+type pubKeyValue ed25519.PublicKey
+
+func (key *pubKeyValue) Set(s string) error {
+	if !netKeyRE.MatchString(s) {
+		return errors.New("invalid public key (must be 64 hexadecimal digits)")
+	}
+	fmt.Sscanf(s, "%x", key) // will succeed
+	return nil
+}
+
+type certValue []byte
+
+func (fp *certValue) Set(s string) error {
+	if !netKeyRE.MatchString(s) {
+		return errors.New("invalid fingerprint (must be 64 hexadecimal digits)")
+	}
+	fmt.Sscanf(s, "%x", fp) // will succeed
+	return nil
+}
+
+type proxyValue conn.Proxy
+
+func (p *proxyValue) Set(s string) error {
+	v, err := conn.ParseProxy(s)
+	if err != nil {
+		return err
+	}
+	*p = proxyValue(*v)
+	return nil
+}
+
+type durValue time.Duration
+
+func (d *durValue) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	if v < 0 {
+		return errors.New("negative duration")
+	}
+	*d = durValue(v)
+	return nil
+}
+
+type boolValue bool
+
+func (b *boolValue) Set(s string) error {
+	switch strings.ToLower(s) {
+	case "yes", "on", "true", "1":
+		*b = true
+	case "no", "off", "false", "0":
+		*b = false
+	default:
+		return errors.New("invalid boolean (must be yes or no)")
+	}
+	return nil
+}
+
 func readConf() error {
 	f, err := os.Open(conffile)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	return conf.Parse(f, conffile, []conf.Var{
+	err = conf.Parse(f, conffile, []conf.Var{
 		{
 			Name: "db",
 			Val:  (*conf.StringValue)(&dbfile),
 		},
 		{
 			Name: "server",
-			Val:  (*conf.StringValue)(&serverAddr),
+			Val:  &servers,
 		},
 		{
 			Name:     "clientid",
@@ -78,45 +173,153 @@ func readConf() error {
 			Required: true,
 		},
 		{
-			Name:     "key",
-			Val:      (*netKeyValue)(&networkKey),
-			Required: true,
+			Name: "key",
+			Val:  (*netKeyValue)(&networkKey),
+		},
+		{
+			Name: "privkey",
+			Val:  (*privKeyValue)(&privKey),
+		},
+		{
+			Name: "serverkey",
+			Val:  (*pubKeyValue)(&serverKey),
+		},
+		{
+			Name: "servercert",
+			Val:  (*certValue)(&serverCert),
+		},
+		{
+			Name: "websocket",
+			Val:  (*boolValue)(&websocket),
+		},
+		{
+			Name: "proxy",
+			Val:  (*proxyValue)(&proxy),
+		},
+		{
+			Name: "maxchecks",
+			Val:  (*conf.Uint64Value)(&maxChecks),
+		},
+		{
+			Name: "persistent",
+			Val:  (*boolValue)(&persistent),
+		},
+		{
+			Name: "reconnect",
+			Val:  (*durValue)(&reconnectTime),
+		},
+		{
+			Name: "reconnectfuzz",
+			Val:  (*durValue)(&reconnectFuzz),
+		},
+		{
+			Name: "retry",
+			Val:  (*durValue)(&retryTime),
+		},
+		{
+			Name: "retryfuzz",
+			Val:  (*durValue)(&retryFuzz),
+		},
+		{
+			Name: "retrymax",
+			Val:  (*durValue)(&retryMax),
 		},
 	})
+	switch {
+	case err != nil:
+		return err
+	case networkKey == nil && privKey == nil:
+		return errors.New("either key or privkey is required")
+	case privKey != nil && serverKey == nil:
+		return errors.New("serverkey is required with privkey")
+	case reconnectTime == 0 || retryTime == 0:
+		return errors.New("reconnect and retry must be positive")
+	case reconnectFuzz >= reconnectTime || retryFuzz >= retryTime:
+		return errors.New("fuzz must be less than the interval")
+	case retryMax < retryTime:
+		return errors.New("retrymax must be at least retry")
+	}
+	return nil
 }
 
+// Bounds for the reconnection interval suggested by the server
 const (
-	reconnectTime = time.Hour
-	reconnectFuzz = time.Minute * 10
-	retryTime     = time.Minute * 10
-	retryFuzz     = time.Minute * 2
+	minSuggested = time.Minute
+	maxSuggested = time.Hour * 24
 )
 
 func durFuzz(dur time.Duration, fuzz time.Duration) time.Duration {
-	return dur - fuzz + time.Duration(rand.Int63n(int64(fuzz)*2))
+	if fuzz <= 0 {
+		return dur
+	}
+	return dur - fuzz + time.Duration(mrand.Int63n(int64(fuzz)*2))
+}
+
+// nextConnection returns the time to wait before connecting again
+// after talk returned ok.  retry is the current backoff interval,
+// doubled after each failure up to retryMax.
+func nextConnection(ok bool, retry *time.Duration) time.Duration {
+	if !ok {
+		dur := durFuzz(*retry, retryFuzz)
+		if *retry *= 2; *retry > retryMax {
+			*retry = retryMax
+		}
+		return dur
+	}
+	*retry = retryTime
+	switch suggested := client.Suggested(); {
+	case client.Streaming(): // the stream broke, reconnect soon
+		return durFuzz(retryTime, retryFuzz)
+	case suggested != 0:
+		if suggested < minSuggested {
+			suggested = minSuggested
+		} else if suggested > maxSuggested {
+			suggested = maxSuggested
+		}
+		return durFuzz(suggested, suggested/6)
+	}
+	return durFuzz(reconnectTime, reconnectFuzz)
 }
 
 func netLoop(headShot <-chan bool) {
-	rand.Seed(int64(time.Now().UnixNano()))
-	var dur time.Duration
+	mrand.Seed(int64(clk.Now().UnixNano()))
+	retry := retryTime
 	for {
-		ok := talk() // connect to server immediately
-		if ok {
-			dur = durFuzz(reconnectTime, reconnectFuzz)
-		} else {
-			dur = durFuzz(retryTime, retryFuzz)
+		ok, killed := talk(headShot) // connect to server immediately
+		if killed {
+			log.Debug("net loop done")
+			return
 		}
+		dur := nextConnection(ok, &retry)
 		log.Debug(fmt.Sprintf("next connection in %v", dur))
 		select {
 		case <-headShot:
 			log.Debug("net loop done")
 			return
-		case <-time.After(dur):
+		case <-clk.After(dur):
 		}
 	}
 }
 
+// genKey prints a new Ed25519 key pair for benchnode.conf and the
+// management "node" command.
+func genKey() {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "can't generate key: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("privkey = %x\n# public key: ed25519:%x\n", priv.Seed(), pub)
+}
+
 func main() {
+	genkey := flag.Bool("genkey", false, "generate Ed25519 key pair and exit")
+	flag.Parse()
+	if *genkey {
+		genKey()
+		return
+	}
+
 	var err error
 	log, err = syslog.New(syslog.LOG_DAEMON,
 		fmt.Sprintf("benchnet.node[%d]", os.Getpid()))
@@ -147,6 +350,21 @@ func main() {
 		os.Exit(1)
 	}
 
+	if confKey = networkKey; confKey != nil {
+		if networkKey, err = loadKey(confKey); err != nil {
+			dbc.Close()
+			log.Err("can't load key: " + err.Error())
+			os.Exit(1)
+		}
+	}
+	if lastServer, err = loadServer(); err != nil {
+		dbc.Close()
+		log.Err("can't load server: " + err.Error())
+		os.Exit(1)
+	}
+
+	initProto()
+	pool = sched.NewPool(int(maxChecks), clk)
 	if err = loadJobs(); err != nil {
 		dbc.Close()
 		log.Err("error while loading jobs from database: " + err.Error())
@@ -0,0 +1,49 @@
+// Benchnet
+//
+// Copyright 2012 Vadim Vygonets
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/unixdj/benchnet/lib/conn"
+	"testing"
+	"time"
+)
+
+func TestNextConnection(t *testing.T) {
+	defer func(c *conn.Client, rf, cf time.Duration) {
+		client, retryFuzz, reconnectFuzz = c, rf, cf
+	}(client, retryFuzz, reconnectFuzz)
+	client = conn.NewClient(0, 0, nil, nil)
+	retryFuzz, reconnectFuzz = 0, 0
+	retry := retryTime
+	for want := retryTime; want < retryMax*2; want *= 2 {
+		if want > retryMax {
+			want = retryMax
+		}
+		if dur := nextConnection(false, &retry); dur != want {
+			t.Fatalf("retry in %v, want %v", dur, want)
+		}
+	}
+	if dur := nextConnection(false, &retry); dur != retryMax {
+		t.Fatalf("retry in %v, want %v", dur, retryMax)
+	}
+	if dur := nextConnection(true, &retry); dur != reconnectTime {
+		t.Fatalf("reconnect in %v, want %v", dur, reconnectTime)
+	}
+	if retry != retryTime {
+		t.Fatalf("retry is %v after success, want %v", retry, retryTime)
+	}
+}
@@ -17,108 +17,158 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
-	"encoding/gob"
-	"errors"
-	"fmt"
+	"crypto/tls"
+	"github.com/unixdj/benchnet/benchnode/check"
 	"github.com/unixdj/benchnet/lib/conn"
-	"io"
+	"net"
 	"time"
 )
 
-var (
-	errProto  = errors.New("protocol error")
-	errFuture = errors.New("timestamp in the future")
+// resultStore and jobSink connect the protocol, implemented in
+// lib/conn, to the database and the scheduler.
+type (
+	resultStore struct{}
+	jobSink     struct{}
 )
 
-type step func(*conn.Conn) (step, error)
+// client talks to the server, see initProto.
+var client *conn.Client
 
-func recvGreet(s *conn.Conn) (step, error) {
-	buf := make([]byte, len(conn.Greet))
-	_, err := io.ReadFull(s, buf)
-	if err != nil {
-		return nil, err
-	}
-	if bytes.Compare(buf[:len(conn.Greet)], []byte(conn.Greet)) != 0 {
-		return nil, conn.ErrProto
+// initProto sets up client once the configuration and the key are
+// loaded.
+func initProto() {
+	client = conn.NewClient(clientId, nodeId, resultStore{}, jobSink{})
+	client.Key, client.PrivKey, client.ServerKey = networkKey, privKey, serverKey
+	client.Checks, client.Persistent = check.Names(), persistent
+	client.Log, client.Clock = log, clk
+	client.NewKey = func(key []byte) error { return saveKey(key, confKey) }
+}
+
+// toConn converts results loaded from the database for sending.
+func toConn(ra []*check.Result) []*conn.Result {
+	r := make([]*conn.Result, len(ra))
+	for i, v := range ra {
+		r[i] = (*conn.Result)(v)
 	}
-	return auth, s.ReceiveChallenge()
+	return r
+}
+
+func (resultStore) ResultsSince(t uint64) ([]*conn.Result, int64, error) {
+	ra, last, err := loadResults(t)
+	return toConn(ra), last, err
 }
 
-func auth(s *conn.Conn) (step, error) {
-	s.Reset()
-	buf := make([]byte, 16, 16+2*conn.KeySize)
-	binary.BigEndian.PutUint64(buf, clientId)
-	binary.BigEndian.PutUint64(buf[8:], nodeId)
-	buf = s.Sign(buf)
-	return sendLogs, s.SendChallenge(buf)
+func (resultStore) ResultsAfter(seq int64, max int) ([]*conn.Result, error) {
+	ra, _, err := loadResultsAfter(seq, max)
+	return toConn(ra), err
 }
 
-func sendLogs(s *conn.Conn) (step, error) {
-	var buf [8]byte
-	if _, err := io.ReadFull(s, buf[:]); err != nil {
-		return nil, err
+func (resultStore) Ack(seq int64) error   { return deleteAcked(seq) }
+func (resultStore) Expire(t uint64) error { return deleteResults(t) }
+
+func (jobSink) SetJobs(l []conn.Job) error {
+	newjobs := make(jobList, len(l))
+	for i, v := range l {
+		newjobs[i] = jobDesc{
+			Id:      v.Id,
+			Period:  v.Period,
+			Start:   v.Start,
+			Check:   v.Check,
+			Overrun: v.Overrun,
+		}
 	}
-	then := binary.BigEndian.Uint64(buf[:])
-	now := uint64(time.Now().UnixNano())
-	if then > now {
-		return nil, errFuture
+	return mergeJobs(newjobs)
+}
+
+// Time to connect to a server before trying the next one
+const connectTimeout = time.Minute
+
+// dialServer connects to the server at addr, host or host:port.
+func dialServer(addr string) (*conn.Conn, error) {
+	dial, via := (&net.Dialer{Timeout: connectTimeout}).Dial, ""
+	if proxy.Addr != "" {
+		dial, via = proxy.Dial, " via "+proxy.String()
 	}
-	if err := s.CheckSig(); err != nil {
-		return nil, err
+	var config *tls.Config
+	if serverCert != nil {
+		config = conn.PinnedConfig(serverCert)
 	}
-	if ra, err := loadResults(then); err != nil {
-		return nil, err
-	} else {
-		log.Debug(fmt.Sprintf("sending %d results", len(ra)))
-		if err = gob.NewEncoder(s).Encode(ra); err != nil {
-			return nil, err
-		}
+	port, over := conn.Port, ""
+	switch {
+	case websocket:
+		port, over = conn.WSPort, " over WebSocket"
+	case config != nil:
+		port, over = conn.TLSPort, " over TLS"
 	}
-	if then > now-uint64(time.Hour)*2 {
-		then = now - uint64(time.Hour)*2
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr += port
 	}
-	deleteResults(then)
-	return recvJobs, s.SendSig()
+	log.Info("connecting to server " + addr + over + via)
+	if websocket {
+		return conn.DialWS(dial, addr, client.Key, config)
+	}
+	return conn.DialVia(dial, "tcp", addr, client.Key, config)
 }
 
-func recvJobs(s *conn.Conn) (step, error) {
-	var newjobs jobList
-	if err := gob.NewDecoder(s).Decode(&newjobs); err != nil {
-		return nil, err
-	}
-	log.Debug(fmt.Sprintf("received %d jobs", len(newjobs)))
-	if err := s.CheckSig(); err != nil {
-		return nil, err
+// srvService returns the SRV service name for the transport in use.
+func srvService() string {
+	switch {
+	case websocket:
+		return srvWS
+	case serverCert != nil:
+		return srvTLS
 	}
-	mergeJobs(newjobs)
-	return sendBye, nil
+	return srvPlain
 }
 
-func sendBye(s *conn.Conn) (step, error) {
-	if _, err := s.Write([]byte{0}); err != nil {
-		return nil, err
+// talk talks to the server.  If the server agrees to stream, talk
+// doesn't return until the connection breaks, in which case ok is
+// true, or headShot fires, in which case killed is true.
+func talk(headShot <-chan bool) (ok, killed bool) {
+	addrs, err := servers.order(srvService(), lastServer)
+	if err != nil {
+		log.Notice("can't find servers: " + err.Error())
+		return false, false
+	}
+	for _, addr := range addrs {
+		s, err := dialServer(addr)
+		if err != nil {
+			log.Notice(err.Error())
+			continue
+		}
+		ok, killed, next := talkTo(s, addr, headShot)
+		s.Close()
+		if !next {
+			return ok, killed
+		}
 	}
-	return nil, s.SendSig()
+	return false, false
 }
 
-func talk() (ok bool) {
-	log.Info("connecting to server " + serverAddr + conn.Port)
-	s, err := conn.Dial("tcp", serverAddr+conn.Port, networkKey)
-	if err != nil {
+// talkTo talks to the server at addr on s.  next is true if the
+// server failed before accepting the node, e.g., a standby closing
+// the connection, so that the next server should be tried.
+func talkTo(s *conn.Conn, addr string, headShot <-chan bool) (ok, killed,
+	next bool) {
+	if err := client.Talk(s); err != nil {
 		log.Notice(err.Error())
-		return false
+		return false, false, !client.Authenticated()
 	}
-	defer s.Close()
-	f, err := recvGreet(s)
-	for f != nil && err == nil {
-		f, err = f(s)
+	if addr != lastServer {
+		if err := saveServer(addr); err != nil {
+			log.Err("can't save server: " + err.Error())
+		}
+		lastServer = addr
 	}
-	if err != nil {
-		log.Notice(err.Error())
-		return false
+	if !client.Streaming() {
+		log.Info("conection completed")
+		return true, false, false
+	}
+	log.Info("streaming")
+	err := client.Stream(s, headShot)
+	if err == conn.ErrKilled {
+		return true, true, false
 	}
-	log.Info("conection completed")
-	return true
+	log.Notice("stream: " + err.Error())
+	return true, false, false // reconnect soon, see nextConnection
 }
@@ -17,11 +17,69 @@
 // Package sched implements a simple scheduler.
 package sched
 
-import "time"
+import (
+	"github.com/unixdj/benchnet/lib/clock"
+	"sync"
+	"time"
+)
+
+// Overrun policies, i.e., what to do when a run is due while the
+// previous one is still running.
+const (
+	Skip       = iota // don't run this time
+	Queue             // run after the previous run finishes, one at most
+	Concurrent        // run anyway
+)
+
+// Pool is shared by schedulers.  It provides the clock and limits
+// the number of functions run concurrently by all of them.
+type Pool struct {
+	c   chan bool
+	clk clock.Clock
+}
+
+// NewPool creates a pool allowing up to max concurrent runs and
+// using clk for timing.  If max is zero, the number of runs is
+// unlimited.  If clk is nil, clock.Real is used.
+func NewPool(max int, clk clock.Clock) *Pool {
+	if clk == nil {
+		clk = clock.Real
+	}
+	if max <= 0 {
+		return &Pool{clk: clk}
+	}
+	return &Pool{c: make(chan bool, max), clk: clk}
+}
+
+// acquire waits for a free slot in p.  It returns false if dying
+// gets closed first.
+func (p *Pool) acquire(dying <-chan bool) bool {
+	if p.c == nil {
+		return true
+	}
+	select {
+	case p.c <- true:
+		return true
+	case <-dying:
+		return false
+	}
+}
+
+// release frees a slot in p.
+func (p *Pool) release() {
+	if p.c != nil {
+		<-p.c
+	}
+}
 
 // Sched represets a scheduler instance.
 type Sched struct {
 	headShot chan bool
+	dying    chan bool      // closed when stopping
+	dead     chan bool      // closed when stopped
+	wg       sync.WaitGroup // running instances of f
+	pool     *Pool
+	f        func(time.Time)
 }
 
 // Stop stops the scheduler s.  If f is currently running, Stop
@@ -29,37 +87,135 @@ type Sched struct {
 // will hang forever.
 func (s *Sched) Stop() {
 	s.headShot <- true
+	<-s.dead
+}
+
+// run runs f for the time t when a slot is available in the pool
+// and reports back via done.
+func (s *Sched) run(t time.Time, done chan<- bool) {
+	defer s.wg.Done()
+	if s.pool.acquire(s.dying) {
+		s.f(t)
+		s.pool.release()
+	}
+	if done != nil {
+		select {
+		case done <- true:
+		case <-s.dying:
+		}
+	}
 }
 
-func (s *Sched) thread(period time.Duration, start time.Duration, f func()) {
+func (s *Sched) thread(period time.Duration, start time.Duration, overrun int) {
+	var (
+		running bool
+		queued  bool      // a run is waiting for the previous one
+		qt      time.Time // time the queued run was due
+		done    = make(chan bool)
+		tick    <-chan time.Time
+		t       time.Time // time the run is due
+	)
+	defer func() {
+		close(s.dying)
+		s.wg.Wait()
+		close(s.dead)
+	}()
 	select {
 	case <-s.headShot:
 		return
-	case <-time.After(start):
+	case t = <-s.pool.clk.After(start):
 	}
-	ticker := time.NewTicker(period)
 	for {
-		f()
-		select {
-		case <-s.headShot:
-			ticker.Stop()
-			return
-		case <-ticker.C:
+		switch {
+		case !running:
+			running = true
+			s.wg.Add(1)
+			go s.run(t, done)
+		case overrun == Queue && !queued:
+			queued, qt = true, t
+		case overrun == Concurrent:
+			s.wg.Add(1)
+			go s.run(t, nil)
+		}
+		// like time.Ticker, drop runs missed due to a stall
+		now, next := s.pool.clk.Now(), t.Add(period)
+		if next.Before(now) {
+			next = next.Add(now.Sub(next) / period * period)
 		}
+		for tick = s.pool.clk.After(next.Sub(now)); tick != nil; {
+			select {
+			case <-s.headShot:
+				return
+			case <-tick:
+				t, tick = next, nil
+			case <-done:
+				running = false
+				if queued {
+					running, queued = true, false
+					s.wg.Add(1)
+					go s.run(qt, done)
+				}
+			}
+		}
+	}
+}
+
+// newSched creates a scheduler in p that will run f.
+func (p *Pool) newSched(f func(time.Time)) *Sched {
+	return &Sched{
+		headShot: make(chan bool),
+		dying:    make(chan bool),
+		dead:     make(chan bool),
+		pool:     p,
+		f:        f,
 	}
 }
 
-// New starts a new scheduler running f each period, at Unix time
-// N*period+offset where N is natural.  No more than one instance
-// of f will run at any given moment.
-func New(period time.Duration, offset time.Duration, f func()) *Sched {
+func (s *Sched) once(at time.Time) {
+	defer func() {
+		close(s.dying)
+		s.wg.Wait()
+		close(s.dead)
+	}()
+	select {
+	case <-s.headShot:
+		return
+	case <-s.pool.clk.After(at.Sub(s.pool.clk.Now())):
+	}
+	s.wg.Add(1)
+	go s.run(at, nil)
+	<-s.headShot
+}
+
+// New starts a new scheduler in p running f each period, at Unix
+// time N*period+offset where N is natural.  f gets the time the run
+// was due, which may be earlier than the time f is called if a slot
+// in p is not immediately available.  If f is still running when
+// the next run is due, overrun decides whether to skip the new run,
+// queue it, or start it concurrently.  At most one run is queued,
+// further ones are skipped.
+func (p *Pool) New(period time.Duration, offset time.Duration, overrun int,
+	f func(time.Time)) *Sched {
 	// This will break after Fri Apr 11 23:47:16 +0000 UTC 2262
-	nanonow := time.Duration(time.Now().UnixNano())
+	nanonow := time.Duration(p.clk.Now().UnixNano())
 	start := period - (nanonow-offset)%period
 	if start < time.Millisecond {
 		start += period
 	}
-	s := Sched{headShot: make(chan bool)}
-	go s.thread(period, start, f)
-	return &s
+	s := p.newSched(f)
+	go s.thread(period, start, overrun)
+	return s
+}
+
+// Once starts a new scheduler in p running f once at the time at,
+// or immediately if at has passed.  f gets the later of at and the
+// time Once was called.  The scheduler has to be stopped even after
+// f has run.
+func (p *Pool) Once(at time.Time, f func(time.Time)) *Sched {
+	if now := p.clk.Now(); at.Before(now) {
+		at = now
+	}
+	s := p.newSched(f)
+	go s.once(at)
+	return s
 }
@@ -0,0 +1,142 @@
+// Benchnet
+//
+// Copyright 2012 Vadim Vygonets
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sched
+
+import (
+	"github.com/unixdj/benchnet/lib/clock"
+	"testing"
+	"time"
+)
+
+const period = time.Minute
+
+// epoch is a multiple of period, so that the first run is due one
+// period later.
+var epoch = time.Unix(1000*60, 0)
+
+// runner records the runs of a scheduler, each of which blocks
+// until released.
+type runner struct {
+	ran     chan time.Time
+	release chan bool
+}
+
+func newRunner() *runner {
+	return &runner{make(chan time.Time, 4), make(chan bool)}
+}
+
+func (r *runner) f(t time.Time) {
+	r.ran <- t
+	<-r.release
+}
+
+// expect checks that the next run was due at epoch plus n periods.
+func (r *runner) expect(t *testing.T, n int) {
+	select {
+	case v := <-r.ran:
+		if want := epoch.Add(period * time.Duration(n)); !v.Equal(want) {
+			t.Fatalf("run due at %v, want %v", v, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("run %d didn't start", n)
+	}
+}
+
+// expectNone checks that no run has started.
+func (r *runner) expectNone(t *testing.T) {
+	select {
+	case v := <-r.ran:
+		t.Fatalf("unexpected run due at %v", v)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+// tick waits until the scheduler waits for the next run and
+// advances clk by period.
+func tick(t *testing.T, clk *clock.Fake) {
+	for i := 0; clk.Waiters() != 1; i++ {
+		if i == 1000 {
+			t.Fatal("scheduler doesn't wait")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	clk.Advance(period)
+}
+
+// settle lets the scheduler notice that a released run finished.
+func settle() {
+	time.Sleep(10 * time.Millisecond)
+}
+
+func TestSkip(t *testing.T) {
+	clk, r := clock.NewFake(epoch), newRunner()
+	s := NewPool(0, clk).New(period, 0, Skip, r.f)
+	defer s.Stop()
+	tick(t, clk)
+	r.expect(t, 1)
+	tick(t, clk)
+	tick(t, clk)
+	r.expectNone(t)
+	r.release <- true
+	settle()
+	tick(t, clk)
+	r.expect(t, 4)
+	r.release <- true
+}
+
+func TestQueue(t *testing.T) {
+	clk, r := clock.NewFake(epoch), newRunner()
+	s := NewPool(0, clk).New(period, 0, Queue, r.f)
+	defer s.Stop()
+	tick(t, clk)
+	r.expect(t, 1)
+	tick(t, clk) // queued
+	tick(t, clk) // skipped, one is queued already
+	r.expectNone(t)
+	r.release <- true
+	r.expect(t, 2)
+	r.release <- true
+	settle()
+	tick(t, clk)
+	r.expect(t, 4)
+	r.release <- true
+}
+
+func TestConcurrent(t *testing.T) {
+	clk, r := clock.NewFake(epoch), newRunner()
+	s := NewPool(0, clk).New(period, 0, Concurrent, r.f)
+	defer s.Stop()
+	tick(t, clk)
+	r.expect(t, 1)
+	tick(t, clk)
+	r.expect(t, 2)
+	r.release <- true
+	r.release <- true
+}
+
+func TestPoolLimit(t *testing.T) {
+	clk, r := clock.NewFake(epoch), newRunner()
+	s := NewPool(1, clk).New(period, 0, Concurrent, r.f)
+	defer s.Stop()
+	tick(t, clk)
+	r.expect(t, 1)
+	tick(t, clk)
+	r.expectNone(t) // waits for a slot
+	r.release <- true
+	r.expect(t, 2) // due time, not start time
+	r.release <- true
+}
@@ -0,0 +1,135 @@
+// Benchnet
+//
+// Copyright 2012 Vadim Vygonets
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+	File servers.go chooses the server to connect to.
+*/
+
+package main
+
+import (
+	"errors"
+	mrand "math/rand"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// server is one entry of the server setting.
+type server struct {
+	addr   string // host or host:port
+	weight int
+}
+
+// serverList is the server setting, see benchnode.conf: either an SRV
+// domain or groups of servers, tried group by group.  Within a group,
+// servers are tried in random order, preferring heavier ones.
+type serverList struct {
+	srv    string // domain for SRV lookup
+	groups [][]server
+}
+
+// SRV service names for each transport
+const (
+	srvPlain = "benchnet"
+	srvTLS   = "benchnet-tls"
+	srvWS    = "benchnet-ws"
+)
+
+func (l *serverList) Set(s string) error {
+	*l = serverList{}
+	if strings.HasPrefix(s, "srv:") {
+		if l.srv = strings.TrimSpace(s[4:]); l.srv == "" {
+			return errors.New("missing SRV domain")
+		}
+		return nil
+	}
+	for _, g := range strings.Split(s, ",") {
+		var group []server
+		for _, f := range strings.Fields(g) {
+			sv := server{addr: f, weight: 1}
+			if i := strings.LastIndex(f, "/"); i >= 0 {
+				w, err := strconv.ParseUint(f[i+1:], 10, 16)
+				if err != nil || w == 0 {
+					return errors.New(f + ": invalid weight")
+				}
+				sv.addr, sv.weight = f[:i], int(w)
+			}
+			if sv.addr == "" {
+				return errors.New(f + ": missing host")
+			}
+			group = append(group, sv)
+		}
+		if group == nil {
+			return errors.New("empty server group")
+		}
+		l.groups = append(l.groups, group)
+	}
+	return nil
+}
+
+// shuffle returns the addresses of group g in random order, each
+// server coming next with probability proportional to its weight.
+func shuffle(g []server) []string {
+	g = append([]server(nil), g...)
+	total := 0
+	for _, sv := range g {
+		total += sv.weight
+	}
+	a := make([]string, 0, len(g))
+	for len(g) != 0 {
+		n := mrand.Intn(total)
+		i := 0
+		for n >= g[i].weight {
+			n -= g[i].weight
+			i++
+		}
+		a = append(a, g[i].addr)
+		total -= g[i].weight
+		g = append(g[:i], g[i+1:]...)
+	}
+	return a
+}
+
+// order returns the addresses to try, in order, for SRV service
+// name service.  last, the server that last succeeded, comes first
+// if it's still listed.
+func (l *serverList) order(service, last string) ([]string, error) {
+	var a []string
+	if l.srv != "" {
+		_, srvs, err := net.LookupSRV(service, "tcp", l.srv)
+		if err != nil {
+			return nil, err
+		}
+		// sorted by priority, randomized by weight
+		for _, v := range srvs {
+			a = append(a, net.JoinHostPort(strings.TrimSuffix(v.Target, "."),
+				strconv.Itoa(int(v.Port))))
+		}
+	} else {
+		for _, g := range l.groups {
+			a = append(a, shuffle(g)...)
+		}
+	}
+	for i, v := range a {
+		if v == last {
+			copy(a[1:i+1], a[:i])
+			a[0] = v
+			break
+		}
+	}
+	return a, nil
+}
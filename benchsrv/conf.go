@@ -0,0 +1,251 @@
+// Benchnet
+//
+// Copyright 2012 Vadim Vygonets
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+	File conf.go reads the configuration file and the command line,
+	and sets up logging.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/unixdj/benchnet/lib/conn"
+	"github.com/unixdj/conf"
+	"io"
+	"log/syslog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Configuration, see benchsrv.conf.  Listeners set to "off" are
+// disabled.
+var (
+	conffile   = "benchsrv.conf"
+	logDest    = "syslog" // "syslog", "stderr" or file name
+	listenAddr = conn.Port
+	tlsAddr    = conn.TLSPort
+	wsAddr     = conn.WSPort
+	mgmtAddr   = "127.0.0.1:25197" // "bm" for benchmgmt
+)
+
+type durValue time.Duration
+
+func (d *durValue) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	if v <= 0 {
+		return errors.New("duration must be positive")
+	}
+	*d = durValue(v)
+	return nil
+}
+
+func (d *durValue) String() string { return time.Duration(*d).String() }
+
+type keyValue []byte
+
+func (key *keyValue) Set(s string) error {
+	if !netKeyRE.MatchString(s) {
+		return errors.New("invalid key (must be 64 hexadecimal digits)")
+	}
+	fmt.Sscanf(s, "%x", key) // will succeed
+	return nil
+}
+
+func (key *keyValue) String() string { return fmt.Sprintf("%x", []byte(*key)) }
+
+type boolValue bool
+
+func (b *boolValue) Set(s string) error {
+	switch strings.ToLower(s) {
+	case "yes", "on", "true", "1":
+		*b = true
+	case "no", "off", "false", "0":
+		*b = false
+	default:
+		return errors.New("invalid boolean (must be yes or no)")
+	}
+	return nil
+}
+
+func (b *boolValue) IsBoolFlag() bool { return true }
+
+func (b *boolValue) String() string {
+	if *b {
+		return "yes"
+	}
+	return "no"
+}
+
+type uintValue uint64
+
+func (v *uintValue) Set(s string) error {
+	n, err := strconv.ParseUint(s, 10, 64)
+	*v = uintValue(n)
+	return err
+}
+
+func (v *uintValue) String() string { return strconv.FormatUint(uint64(*v), 10) }
+
+type stringValue string
+
+func (v *stringValue) Set(s string) error { *v = stringValue(s); return nil }
+func (v *stringValue) String() string     { return string(*v) }
+
+// confVars are the variables set in the configuration file and by
+// flags of the same names.
+var confVars = []struct {
+	name, usage string
+	val         flag.Value
+}{
+	{"dbtype", `database type: "sqlite3" or "postgres"`,
+		storeValue{&store}},
+	{"db", "database file or PostgreSQL connection string",
+		(*stringValue)(&dbfile)},
+	{"log", `log destination: "syslog", "stderr" or file`,
+		(*stringValue)(&logDest)},
+	{"listen", "address for node connections", (*stringValue)(&listenAddr)},
+	{"tlslisten", "address for node connections over TLS",
+		(*stringValue)(&tlsAddr)},
+	{"wslisten", "address for node connections over WebSocket",
+		(*stringValue)(&wsAddr)},
+	{"mgmtlisten", "address for management connections",
+		(*stringValue)(&mgmtAddr)},
+	{"mgmtkey", "management key (64 hexadecimal digits)",
+		(*keyValue)(&mgmtKey)},
+	{"tlscert", "TLS certificate file", (*stringValue)(&tlsCert)},
+	{"tlskey", "TLS private key file", (*stringValue)(&tlsKey)},
+	{"serverkey", "Ed25519 private key file", (*stringValue)(&serverKeyFile)},
+	{"repllisten", "address for replication links",
+		(*stringValue)(&replAddr)},
+	{"peer", "replication address of the other server",
+		(*stringValue)(&peerAddr)},
+	{"replkey", "replication key (64 hexadecimal digits)",
+		(*keyValue)(&replKey)},
+	{"standby", "start as standby if the database has no role",
+		(*boolValue)(&initStandby)},
+	{"schedule", "interval between scheduling runs",
+		(*durValue)(&schedInterval)},
+	{"authtimeout", "time for a node to authenticate",
+		(*durValue)(&authTimeout)},
+	{"retention", "days to keep results, 0 for ever",
+		(*uintValue)(&retainResults)},
+	{"hourlyretention", "days to keep hourly rollups, 0 for ever",
+		(*uintValue)(&retainHourly)},
+}
+
+// readConf parses the command line and the configuration file.  Flags
+// override the file, which needn't exist unless named by -c.
+func readConf() error {
+	flag.StringVar(&conffile, "c", conffile, "configuration file")
+	for _, v := range confVars {
+		flag.Var(v.val, v.name, v.usage)
+	}
+	flag.Parse()
+	if flag.NArg() != 0 {
+		return errors.New("usage: benchsrv [flags]")
+	}
+	set := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = f.Value.String() })
+	_, named := set["c"]
+	f, err := os.Open(conffile)
+	switch {
+	case os.IsNotExist(err) && !named:
+	case err != nil:
+		return err
+	default:
+		vars := make([]conf.Var, len(confVars))
+		for i, v := range confVars {
+			vars[i] = conf.Var{Name: v.name, Val: v.val}
+		}
+		err = conf.Parse(f, conffile, vars)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	for _, v := range confVars {
+		if s, ok := set[v.name]; ok {
+			v.val.Set(s) // succeeded before
+		}
+	}
+	if replKey == nil && (peerAddr != "" || replAddr != "off") {
+		return errors.New("replkey is required for replication")
+	}
+	return nil
+}
+
+// logger is implemented by *syslog.Writer and *fileLogger.
+type logger interface {
+	Debug(m string) error
+	Info(m string) error
+	Notice(m string) error
+	Warning(m string) error
+	Err(m string) error
+	Close() error
+}
+
+// fileLogger writes timestamped messages to a file.
+type fileLogger struct {
+	mu  sync.Mutex
+	w   io.WriteCloser
+	tag string
+}
+
+func (l *fileLogger) write(level, m string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err := fmt.Fprintf(l.w, "%s %s %s: %s\n",
+		time.Now().Format(time.RFC3339), l.tag, level, m)
+	return err
+}
+
+func (l *fileLogger) Debug(m string) error   { return l.write("debug", m) }
+func (l *fileLogger) Info(m string) error    { return l.write("info", m) }
+func (l *fileLogger) Notice(m string) error  { return l.write("notice", m) }
+func (l *fileLogger) Warning(m string) error { return l.write("warning", m) }
+func (l *fileLogger) Err(m string) error     { return l.write("err", m) }
+
+func (l *fileLogger) Close() error {
+	if l.w == os.Stderr {
+		return nil
+	}
+	return l.w.Close()
+}
+
+// openLog opens the log destination set by logDest.
+func openLog() (logger, error) {
+	tag := fmt.Sprintf("benchnet.server[%d]", os.Getpid())
+	switch strings.ToLower(logDest) {
+	case "syslog":
+		return syslog.New(syslog.LOG_DAEMON, tag)
+	case "stderr":
+		return &fileLogger{w: os.Stderr, tag: tag}, nil
+	}
+	f, err := os.OpenFile(logDest, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &fileLogger{w: f, tag: tag}, nil
+}
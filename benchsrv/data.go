@@ -26,10 +26,13 @@
 package main
 
 import (
+	"crypto/subtle"
 	"errors"
 	"fmt"
+	"github.com/unixdj/benchnet/lib/conn"
 	"math/rand"
 	"sort"
+	"strings"
 	"time"
 )
 
@@ -37,41 +40,56 @@ type (
 	geoloc uint64 // Geolocation
 	blob   []byte // kinda-nullable blob for db access
 
-	// job description as sent to client and stored in node
-	jobDesc struct {
-		Id            uint64
-		Period, Start int
-		Check         []string
-	}
+	// job description as sent to client and stored in node;
+	// overrun policies are listed in overrunNames
+	jobDesc = conn.Job
 
 	jobList []jobDesc
 
+	// client owning nodes and jobs
+	client struct {
+		id          uint64
+		name        string
+		key         blob // management key, empty if none, see mgmtAuth
+		nodes, jobs int  // number owned, as of getClient
+	}
+
 	// job
 	job struct {
 		jobDesc          // desc
+		client  uint64   // owner
 		capa    int      // capacity of one job instance
 		nodes   []uint64 // node IDs running the job (len == have, cap == want), unsorted
+		region  geoloc   // location of nodes allowed to run the job
+		local   bool     // region is set
+	}
+
+	// key a node may authenticate with
+	nodeKey struct {
+		key                 blob  // network key, or Ed25519 public key if pub
+		pub                 bool  // key is an Ed25519 public key
+		notBefore, notAfter int64 // validity, ns since Unix epoch, 0 if unbounded
 	}
 
 	// Node
 	node struct {
-		id         uint64  // id
-		lastSeen   uint64  // Time last connected
-		capa, used int     // capacity
-		loc        geoloc  // location
-		key        blob    // Network key
-		jobs       jobList // jobs we want on this node, sorted by id
+		id         uint64    // id
+		client     uint64    // owner
+		lastSeen   uint64    // Time last connected
+		capa, used int       // capacity
+		loc        geoloc    // location
+		keys       []nodeKey // oldest first; replaced, never modified
+		caps       []string  // capabilities, sorted; nil for version 0
+		acked      int64     // highest seq of results committed
+		seen       int64     // highest seq of results received
+		skew       int64     // clock skew last reported, ns
+		jobs       jobList   // jobs we want on this node, sorted by id
 	}
 
 	// Result
 	result struct {
-		nodeId uint64   // Id of node that ran the check; unseen by gob
-		JobId  uint64   // Id of job that started the check
-		Flags  int      // Flags (failure)
-		Start  int64    // Time the check ran, nanoseconds since Unix epoch
-		RT     int64    // Run Time of the check, nanoseconds
-		Errs   string   // Error string returned by libraries
-		S      []string // Results of the run (e.g., HTTP headers)
+		nodeId      uint64 // Id of node that ran the check
+		conn.Result        // as sent by the node
 	}
 
 	jobRequest struct {
@@ -83,15 +101,24 @@ type (
 		id uint64
 		c  chan *node
 	}
+
+	clientRequest struct {
+		id uint64
+		c  chan *client
+	}
 )
 
 var (
-	jobReqChan    = make(chan jobRequest, 5)  // async
-	nodeReqChan   = make(chan nodeRequest, 5) // async
-	schedReqChan  = make(chan bool, 2)        // async
-	commitReqChan = make(chan bool, 2)        // async
+	jobReqChan    = make(chan jobRequest, 5)    // async
+	nodeReqChan   = make(chan nodeRequest, 5)   // async
+	clientReqChan = make(chan clientRequest, 5) // async
+	schedReqChan  = make(chan bool, 2)          // async
+	commitReqChan = make(chan bool, 2)          // async
 )
 
+// Interval between scheduling runs, besides those requested on changes
+var schedInterval = 10 * time.Minute
+
 const (
 	opAddLink = iota
 	opRmLink
@@ -101,23 +128,41 @@ const (
 	opRmJob
 	opNodeSeen
 	opAddResults
+	opAddOnce
+	opWatch
+	opUnwatch
+	opAddKey
+	opSetCaps
+	opAddClient
+	opRmClient
+	opFindKey
+	opList
 )
 
 type opRequest struct {
-	op int
-	j  *job
-	n  *node
-	r  []result
+	op  int
+	j   *job
+	n   *node
+	c   *client
+	r   []result
+	ids []uint64    // opAddOnce
+	w   chan bool   // opWatch, opUnwatch
+	t   int64       // opAddKey: when older keys expire
+	k   []byte      // opFindKey: client key to look up
+	id  chan uint64 // opFindKey: id of the client, closed if none
+	l   chan string // opList
 }
 
 var opChan = make(chan opRequest) // synchronous
 
 type dataDiff struct {
-	op     int
-	jobId  uint64 // opAddLink, opRmLink, opRmJob
-	nodeId uint64 // opAddLink, opRmLink, opRmNode
-	j      *job   // opAddJob
-	n      *node  // opAddNode
+	op       int
+	jobId    uint64  // opAddLink, opRmLink, opRmJob
+	nodeId   uint64  // opAddLink, opRmLink, opRmNode
+	clientId uint64  // opRmClient
+	j        *job    // opAddJob
+	n        *node   // opAddNode
+	c        *client // opAddClient
 }
 
 // On sufficiently large data sets binary search becomes slow
@@ -127,17 +172,30 @@ type dataDiff struct {
 type (
 	jlist    []*job
 	nlist    []*node
+	clist    []*client
 	difflist []dataDiff
 	reslist  []result
 )
 
 var (
-	jobs    jlist    // list of jobs (sorted by geo?)
-	nodes   nlist    // list of nodes
-	diffs   difflist // list of operations to perform on db
-	results reslist  // list of results to commit to db
+	jobs     jlist                    // list of jobs (sorted by geo?)
+	nodes    nlist                    // list of nodes
+	clients  clist                    // list of clients
+	diffs    difflist                 // list of operations to perform on db
+	results  reslist                  // list of results to commit to db
+	watchers = map[uint64]chan bool{} // streams of nodes, by node id
 )
 
+// capabilities of version 0 nodes
+var legacyCaps = []string{
+	conn.CapCheck + "dns",
+	conn.CapCheck + "http.get",
+	conn.CapCheck + "http.head",
+}
+
+// overrun policies as in benchnode/sched
+var overrunNames = []string{"skip", "queue", "concurrent"}
+
 var errDataType = errors.New("wrong data type")
 
 func (b *blob) Scan(value interface{}) error {
@@ -152,11 +210,39 @@ func (b *blob) Scan(value interface{}) error {
 	return nil
 }
 
+func (k *nodeKey) String() string {
+	s := fmt.Sprintf("key %x", []byte(k.key))
+	if k.pub {
+		s = fmt.Sprintf("key ed25519:%x", []byte(k.key))
+	}
+	if k.notBefore != 0 {
+		s += fmt.Sprintf(" from %v", time.Unix(0, k.notBefore))
+	}
+	if k.notAfter != 0 {
+		s += fmt.Sprintf(" until %v", time.Unix(0, k.notAfter))
+	}
+	return s
+}
+
+func (c *client) String() string {
+	return fmt.Sprintf("Client %v\nname %q\n\n", c.id, c.name)
+}
+
 func (n *node) String() string {
-	s := fmt.Sprintf("Node %v\nlastSeen %v\n"+
-		"capacity %v, used %v\ngeolocation %v\nkey %x\njobs:",
-		n.id, time.Unix(0, int64(n.lastSeen)),
-		n.capa, n.used, n.loc, n.key)
+	s := fmt.Sprintf("Node %v\nclient %v\nlastSeen %v\n"+
+		"capacity %v, used %v\ngeolocation %v\n",
+		n.id, n.client, time.Unix(0, int64(n.lastSeen)),
+		n.capa, n.used, n.loc)
+	for i := range n.keys {
+		s += n.keys[i].String() + "\n"
+	}
+	if n.caps != nil {
+		s += fmt.Sprintf("capabilities %v\n", n.caps)
+	}
+	if n.skew != 0 {
+		s += fmt.Sprintf("clock skew %v\n", time.Duration(n.skew))
+	}
+	s += "jobs:"
 	for _, j := range n.jobs {
 		s += fmt.Sprintf(" %v", j.Id)
 	}
@@ -164,9 +250,26 @@ func (n *node) String() string {
 }
 
 func (j *job) String() string {
-	return fmt.Sprintf("Job %v\nperiod %vs, start %v\ncapacity %v\n"+
+	var when, region string
+	switch {
+	case j.Period != 0:
+		overrun := "unknown"
+		if j.Overrun >= 0 && j.Overrun < len(overrunNames) {
+			overrun = overrunNames[j.Overrun]
+		}
+		when = fmt.Sprintf("period %vs, start %v, overrun %v",
+			j.Period, j.Start, overrun)
+	case j.Start != 0:
+		when = fmt.Sprintf("once at %v", time.Unix(int64(j.Start), 0))
+	default:
+		when = "once on connection"
+	}
+	if j.local {
+		region = fmt.Sprintf("\nregion %v", j.region)
+	}
+	return fmt.Sprintf("Job %v\nclient %v\n%v%v\ncapacity %v\n"+
 		"check %+q\nnodes %v (%v/%v)\n\n",
-		j.Id, j.Period, j.Start, j.capa,
+		j.Id, j.client, when, region, j.capa,
 		j.Check, j.nodes, len(j.nodes), cap(j.nodes))
 }
 
@@ -186,6 +289,36 @@ func (j jlist) String() string {
 	return s
 }
 
+func (c clist) String() string {
+	var s string
+	for _, v := range c {
+		s += v.String()
+	}
+	return s
+}
+
+// owned returns nodes of l owned by client id.
+func (l nlist) owned(id uint64) nlist {
+	var t nlist
+	for _, v := range l {
+		if v.client == id {
+			t = append(t, v)
+		}
+	}
+	return t
+}
+
+// owned returns jobs of l owned by client id.
+func (l jlist) owned(id uint64) jlist {
+	var t jlist
+	for _, v := range l {
+		if v.client == id {
+			t = append(t, v)
+		}
+	}
+	return t
+}
+
 func (l jlist) Len() int           { return len(l) }
 func (l jlist) Less(i, j int) bool { return l[i].Id < l[j].Id }
 func (l jlist) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
@@ -222,6 +355,24 @@ func (l nlist) find(id uint64) *node {
 	return l[i]
 }
 
+func (l clist) Len() int           { return len(l) }
+func (l clist) Less(i, j int) bool { return l[i].id < l[j].id }
+func (l clist) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// index returns index in l where client with given id is or should be.
+func (l clist) index(id uint64) int {
+	return sort.Search(len(l), func(i int) bool { return l[i].id >= id })
+}
+
+// find retrieves a client from l by id.
+func (l clist) find(id uint64) *client {
+	i := l.index(id)
+	if i == len(l) || l[i].id != id {
+		return nil
+	}
+	return l[i]
+}
+
 // index returns index in l where job with given id is or should be.
 func (l jobList) index(id uint64) int {
 	return sort.Search(len(l), func(i int) bool { return l[i].Id >= id })
@@ -240,7 +391,80 @@ func (j *job) runnable() bool {
 
 // canRun checks if n wants to run j.
 func (n *node) canRun(j *job) bool {
-	return j.capa <= n.capa-n.used && !j.in(n.jobs)
+	return j.client == n.client && j.capa <= n.capa-n.used &&
+		!j.in(n.jobs) && (!j.local || j.region == n.loc) && n.supports(j)
+}
+
+// supports checks if n has the capabilities needed to run j.
+func (n *node) supports(j *job) bool {
+	caps := n.caps
+	if caps == nil {
+		caps = legacyCaps
+	}
+	var once, check bool
+	for _, c := range caps {
+		switch {
+		case c == conn.CapOnce:
+			once = true
+		case strings.HasPrefix(c, conn.CapCheck):
+			check = check || checkMatches(c[len(conn.CapCheck):], j.Check)
+		}
+	}
+	return check && (once || !j.once())
+}
+
+// checkMatches checks if the check path (e.g., "http.get") is the
+// start of the check command cmd.
+func checkMatches(path string, cmd []string) bool {
+	p := strings.Split(path, ".")
+	if len(p) > len(cmd) {
+		return false
+	}
+	for i, v := range p {
+		if v != cmd[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// valid checks if k may be used at time t.
+func (k *nodeKey) valid(t int64) bool {
+	return (k.notBefore == 0 || k.notBefore <= t) &&
+		(k.notAfter == 0 || t < k.notAfter)
+}
+
+// validKeys returns keys of n valid at time t, newest first.
+func (n *node) validKeys(t int64) []nodeKey {
+	var l []nodeKey
+	for i := len(n.keys) - 1; i >= 0; i-- {
+		if n.keys[i].valid(t) {
+			l = append(l, n.keys[i])
+		}
+	}
+	return l
+}
+
+// rotateKeys returns l with expired keys dropped, other keys expiring
+// no later than until, and k appended.
+func rotateKeys(l []nodeKey, k nodeKey, until int64) []nodeKey {
+	now := clk.Now().UnixNano()
+	t := make([]nodeKey, 0, len(l)+1)
+	for _, v := range l {
+		if v.notAfter != 0 && v.notAfter <= now {
+			continue
+		}
+		if v.notAfter == 0 || v.notAfter > until {
+			v.notAfter = until
+		}
+		t = append(t, v)
+	}
+	return append(t, k)
+}
+
+// once checks if j is a one-shot job.
+func (j *job) once() bool {
+	return j.Period == 0
 }
 
 // doAddNode adds n to nodes.
@@ -261,6 +485,24 @@ func doRmNode(n *node) {
 	}
 }
 
+// doAddClient adds c to clients.
+func doAddClient(c *client) {
+	i := clients.index(c.id)
+	if i < len(clients) && clients[i].id == c.id {
+		clients[i] = c
+	} else {
+		clients = append(clients[:i], append(clist{c}, clients[i:]...)...)
+	}
+}
+
+// doRmClient removes c from clients.
+func doRmClient(c *client) {
+	i := clients.index(c.id)
+	if i < len(clients) && clients[i].id == c.id {
+		clients = append(clients[:i], clients[i+1:]...)
+	}
+}
+
 // doAddJob adds j to jobs.
 func doAddJob(j *job) {
 	i := jobs.index(j.Id)
@@ -306,15 +548,34 @@ func (n *node) doRmJob(j *job) {
 	n.used -= j.capa
 }
 
+// standbyOp checks if op is performed on a standby, which only
+// watches nodes and answers lookups.
+func standbyOp(op int) bool {
+	switch op {
+	case opWatch, opUnwatch, opFindKey, opList:
+		return true
+	}
+	return false
+}
+
 // doOp performs an operation and adds a record to dataDiff list.
 func doOp(r opRequest) {
+	if !replActive && !standbyOp(r.op) {
+		log.Debug(fmt.Sprintf("standby: ignoring op %d", r.op))
+		return
+	}
 	switch r.op {
 	case opAddLink, opRmLink:
 		if r.op == opAddLink {
+			// r may come from outside with copies of j and n
+			if r.n, r.j = nodes.find(r.n.id), jobs.find(r.j.Id); r.n == nil || r.j == nil {
+				return
+			}
 			r.n.doAddJob(r.j)
 		} else {
 			r.n.doRmJob(r.j)
 		}
+		notify(r.n.id)
 		var (
 			l    = dataDiff{op: r.op, jobId: r.j.Id, nodeId: r.n.id}
 			notl = dataDiff{op: r.op ^ 1, jobId: r.j.Id, nodeId: r.n.id}
@@ -329,16 +590,24 @@ func doOp(r opRequest) {
 			}
 		}
 		diffs = append(diffs, l)
-	case opNodeSeen:
+	case opNodeSeen, opAddKey, opSetCaps:
 		tmp := nodes.find(r.n.id)
 		if tmp == nil {
 			return
 		}
-		tmp.lastSeen = r.n.lastSeen
+		switch r.op {
+		case opNodeSeen:
+			tmp.lastSeen = r.n.lastSeen
+		case opAddKey:
+			tmp.keys = rotateKeys(tmp.keys, r.n.keys[0], r.t)
+		case opSetCaps:
+			tmp.caps = r.n.caps
+			dropUnsupported(tmp)
+		}
 		r.n = tmp
 		fallthrough
 	case opAddNode:
-		if r.op == opAddNode { // opNodeSeen modifies node in place
+		if r.op == opAddNode { // others modify node in place
 			doAddNode(r.n)
 		}
 		for i, v := range diffs {
@@ -352,6 +621,7 @@ func doOp(r opRequest) {
 		}
 		diffs = append(diffs, dataDiff{op: opAddNode, n: copyNode(r.n)})
 	case opRmNode:
+		defer notify(r.n.id)
 		tmpn := nodes.find(r.n.id)
 		for _, v := range tmpn.jobs {
 			doOp(opRequest{
@@ -404,8 +674,104 @@ func doOp(r opRequest) {
 		}
 		diffs = append(diffs, dataDiff{op: r.op, jobId: r.j.Id})
 	case opAddResults:
-		results = append(results, r.r...)
+		for _, v := range r.r {
+			n, j := nodes.find(v.nodeId), jobs.find(v.JobId)
+			if n != nil && v.Seq != 0 {
+				if v.Seq <= n.seen {
+					continue // sent again
+				}
+				n.seen = v.Seq
+			}
+			if n != nil {
+				n.skew = v.Skew
+			}
+			if n != nil && j != nil && j.client != n.client {
+				log.Notice(fmt.Sprintf("node %d sent result of job %d of another client",
+					n.id, j.Id))
+				continue
+			}
+			results = append(results, v)
+			if j != nil && j.once() {
+				finishOnce(j, v.nodeId)
+			}
+		}
+	case opAddOnce:
+		doOp(opRequest{op: opAddJob, j: r.j})
+		for _, id := range r.ids {
+			if n := nodes.find(id); n != nil {
+				doOp(opRequest{op: opAddLink, j: r.j, n: n})
+			}
+		}
+	case opAddClient:
+		doAddClient(r.c)
+		diffs = append(diffs, dataDiff{op: opAddClient, c: r.c})
+	case opRmClient:
+		if c := doGetClient(r.c.id); c == nil || c.nodes != 0 || c.jobs != 0 {
+			return // still owns something
+		}
+		doRmClient(r.c)
+		diffs = append(diffs, dataDiff{op: opRmClient, clientId: r.c.id})
+	case opWatch:
+		watchers[r.n.id] = r.w
+	case opUnwatch:
+		if watchers[r.n.id] == r.w {
+			delete(watchers, r.n.id)
+		}
+	case opFindKey:
+		for _, c := range clients {
+			if subtle.ConstantTimeCompare(r.k, c.key) == 1 {
+				r.id <- c.id
+				break
+			}
+		}
+		close(r.id)
+	case opList:
+		if r.c != nil {
+			r.l <- nodes.owned(r.c.id).String() + jobs.owned(r.c.id).String()
+		} else {
+			r.l <- clients.String() + nodes.String() + jobs.String()
+		}
+	}
+}
+
+// dropUnsupported unlinks jobs that n can't run from n.
+func dropUnsupported(n *node) {
+	var drop bool
+	for _, v := range append(jobList{}, n.jobs...) {
+		if j := jobs.find(v.Id); j != nil && !n.supports(j) {
+			doOp(opRequest{op: opRmLink, j: j, n: n})
+			drop = true
+		}
+	}
+	if drop {
+		requestSchedule()
+	}
+}
+
+// notify tells the stream of node id, if any, that its job list has
+// changed.
+func notify(id uint64) {
+	if w, ok := watchers[id]; ok {
+		select {
+		case w <- true:
+		default:
+		}
+	}
+}
+
+// finishOnce unlinks one-shot job j from node id after it has run
+// there.  The job wants one run less, so it doesn't get scheduled
+// to another node.
+func finishOnce(j *job, id uint64) {
+	n := nodes.find(id)
+	if n == nil || !j.in(n.jobs) {
+		return
 	}
+	doOp(opRequest{op: opRmLink, j: j, n: n})
+	jn := make([]uint64, len(j.nodes), cap(j.nodes)-1)
+	copy(jn, j.nodes)
+	j.nodes = jn
+	doOp(opRequest{op: opAddJob, j: j})
 }
 
 // addJob adds j to n's job list.
@@ -426,7 +792,7 @@ func perm(n nlist) nlist {
 // schedule attempts to schedule uscheduled jobs.
 // TODO: make scheduler concurrent.
 func schedule() {
-	if len(nodes) == 0 || len(jobs) == 0 {
+	if !replActive || len(nodes) == 0 || len(jobs) == 0 {
 		return
 	}
 	var (
@@ -508,6 +874,19 @@ func doGetNode(id uint64) *node {
 	return copyNode(np)
 }
 
+// doGetClient retrieves a copy of client specified by id, with the
+// number of nodes and jobs it owns.
+// You probably want to call getClient() instead.
+func doGetClient(id uint64) *client {
+	cp := clients.find(id)
+	if cp == nil {
+		return nil
+	}
+	c := *cp
+	c.nodes, c.jobs = len(nodes.owned(id)), len(jobs.owned(id))
+	return &c
+}
+
 func dataInit() error {
 	err := dbOpen()
 	if dbc == nil {
@@ -522,22 +901,70 @@ func dataInit() error {
 		return errors.New("can't load database: " + err.Error())
 	}
 	log.Debug("database loaded")
+	if err = replInit(); err != nil {
+		dbClose()
+		return errors.New("can't load replication state: " + err.Error())
+	}
 	return nil
 }
 
-func commit(done chan<- bool) {
-	if len(diffs) == 0 && len(results) == 0 {
-		done <- false
+// diffs and results being committed
+var (
+	commitDiffs   difflist
+	commitResults reslist
+)
+
+var errNoCommit = errors.New("nothing to commit")
+
+// commit starts committing diffs and results.  The outcome is sent
+// to done.
+func commit(done chan<- error) {
+	if !replActive || len(diffs) == 0 && len(results) == 0 {
+		done <- errNoCommit
 		return
 	}
-	d, r := diffs, results
+	commitDiffs, commitResults = diffs, results
 	if len(diffs) != 0 {
 		diffs = make(difflist, 0, 16)
 	}
 	if len(results) != 0 {
 		results = make(reslist, 0, 16)
 	}
-	go dbCommit(d, r, done)
+	go dbCommit(commitDiffs, commitResults, done)
+}
+
+// commitDone handles the outcome of commit.  On success, results are
+// acknowledged to their nodes.  On failure, the diffs and results are
+// put back to be committed later.
+func commitDone(err error) {
+	d, r := commitDiffs, commitResults
+	commitDiffs, commitResults = nil, nil
+	switch err {
+	case nil:
+		log.Debug("data loop: commit done")
+	case errNoCommit:
+		log.Debug("data loop: nothing to commit")
+		return
+	default:
+		if !replActive {
+			log.Warning("commit failed on standby: " + err.Error())
+			return
+		}
+		log.Warning("commit failed, will retry: " + err.Error())
+		diffs = append(d, diffs...)
+		results = append(r, results...)
+		return
+	}
+	if !replActive { // stepped down while committing
+		return
+	}
+	for _, v := range r {
+		if n := nodes.find(v.nodeId); n != nil && v.Seq > n.acked {
+			n.acked = v.Seq
+			notify(n.id)
+		}
+	}
+	replCommitted(d, r)
 }
 
 func dataLoop(initDone chan<- error, headShot <-chan bool, done chan<- bool) {
@@ -553,8 +980,8 @@ func dataLoop(initDone chan<- error, headShot <-chan bool, done chan<- bool) {
 	}
 	var (
 		committing bool
-		commitDone = make(chan bool, 2)
-		t          = time.NewTicker(10 * time.Minute)
+		commitc    = make(chan error, 2)
+		t          = clk.NewTicker(schedInterval)
 	)
 	defer func() {
 		if err := recover(); err != nil {
@@ -562,12 +989,12 @@ func dataLoop(initDone chan<- error, headShot <-chan bool, done chan<- bool) {
 		}
 		t.Stop()
 		if committing {
-			<-commitDone
+			commitDone(<-commitc)
 			committing = false
 		}
 		// final commit
-		commit(commitDone)
-		<-commitDone
+		commit(commitc)
+		commitDone(<-commitc)
 		dbClose()
 	}()
 	schedReqChan <- true
@@ -576,24 +1003,21 @@ func dataLoop(initDone chan<- error, headShot <-chan bool, done chan<- bool) {
 		case <-headShot:
 			log.Debug("data loop: headshot")
 			return
-		case <-t.C:
+		case <-t.C():
 			requestSchedule()
 		case <-schedReqChan:
 			schedule()
 			requestCommit()
 		case <-commitReqChan:
 			if !committing {
-				commit(commitDone)
+				commit(commitc)
 				committing = true
 			}
-		case r := <-commitDone:
+		case err := <-commitc:
 			if !committing {
 				log.Warning("dataLoop(): commit done while not committing")
-			} else if r {
-				log.Debug("data loop: commit done")
-			} else {
-				log.Debug("data loop: nothing to commit")
 			}
+			commitDone(err)
 			committing = false
 		case r := <-jobReqChan:
 			log.Debug("data loop: job request")
@@ -601,9 +1025,15 @@ func dataLoop(initDone chan<- error, headShot <-chan bool, done chan<- bool) {
 		case r := <-nodeReqChan:
 			log.Debug("data loop: node request")
 			r.c <- doGetNode(r.id)
+		case r := <-clientReqChan:
+			log.Debug("data loop: client request")
+			r.c <- doGetClient(r.id)
 		case r := <-opChan:
 			log.Debug(fmt.Sprintf("data loop: add op %d", r.op))
 			doOp(r)
+		case r := <-replReqChan:
+			log.Debug(fmt.Sprintf("data loop: replication request %d", r.op))
+			doRepl(r)
 		}
 	}
 }
@@ -622,6 +1052,13 @@ func getNode(id uint64) *node {
 	return <-c
 }
 
+// getClient fetches a copy of the client specified by id.
+func getClient(id uint64) *client {
+	c := make(chan *client)
+	clientReqChan <- clientRequest{id, c}
+	return <-c
+}
+
 func addLink(j *job, n *node) { opChan <- opRequest{op: opAddLink, j: j, n: n} }
 func rmLink(j *job, n *node)  { opChan <- opRequest{op: opRmLink, j: j, n: n} }
 func addNode(n *node)         { opChan <- opRequest{op: opAddNode, n: n} }
@@ -630,6 +1067,51 @@ func addJob(j *job)           { opChan <- opRequest{op: opAddJob, j: j} }
 func rmJob(j *job)            { opChan <- opRequest{op: opRmJob, j: j} }
 func nodeSeen(n *node)        { opChan <- opRequest{op: opNodeSeen, n: n} }
 func addResults(r []result)   { opChan <- opRequest{op: opAddResults, r: r} }
+func addClient(c *client)     { opChan <- opRequest{op: opAddClient, c: c} }
+
+// rmClient removes client c unless it owns nodes or jobs.
+func rmClient(c *client) { opChan <- opRequest{op: opRmClient, c: c} }
+
+// findKey looks up the client with key k.
+func findKey(k []byte) (id uint64, ok bool) {
+	c := make(chan uint64, 1)
+	opChan <- opRequest{op: opFindKey, k: k, id: c}
+	id, ok = <-c
+	return
+}
+
+// list returns the list of clients, nodes and jobs, or only of nodes
+// and jobs of client c if not nil.
+func list(c *client) string {
+	l := make(chan string, 1)
+	opChan <- opRequest{op: opList, c: c, l: l}
+	return <-l
+}
+
+// addOnce adds one-shot job j and links it to nodes ids.
+func addOnce(j *job, ids []uint64) { opChan <- opRequest{op: opAddOnce, j: j, ids: ids} }
+
+// addKey adds key k to node id.  The node's other keys expire at
+// until, or earlier if they already do.
+func addKey(id uint64, k nodeKey, until int64) {
+	opChan <- opRequest{op: opAddKey, n: &node{id: id, keys: []nodeKey{k}}, t: until}
+}
+
+// setCaps sets capabilities of node id, unlinking jobs it can't run.
+func setCaps(id uint64, caps []string) {
+	opChan <- opRequest{op: opSetCaps, n: &node{id: id, caps: caps}}
+}
+
+// watchNode makes the data loop notify w when the job list of node id
+// changes, until unwatchNode is called.  Only one channel is notified
+// per node.
+func watchNode(id uint64, w chan bool) {
+	opChan <- opRequest{op: opWatch, n: &node{id: id}, w: w}
+}
+
+func unwatchNode(id uint64, w chan bool) {
+	opChan <- opRequest{op: opUnwatch, n: &node{id: id}, w: w}
+}
 
 func requestSchedule() {
 	if len(schedReqChan) == 0 {
@@ -17,68 +17,174 @@
 package main
 
 import (
+	"database/sql"
 	"fmt"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/unixdj/benchnet/lib/stdb"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 /*
-database schema:
+database schema (SQLite types shown, see store.go for PostgreSQL):
+
+table clients:
+	id	client id; client 0 owns nodes and jobs from before clients
+	name	name of the client
+	key	management key of the client, or NULL
 
 table nodes:
 	id	node id
+	client	id of client owning the node
 	last	time when node connected last, nanoseconds since Unix epoch
 	capa	total capacity of jobs the node is prepared to run
 	loc	geolocation
-	key	network key
+	key	obsolete, moved to table keys
+	pub	obsolete, moved to table keys
+	caps	space-separated capabilities, NULL for version 0 nodes
+
+table keys:
+	node	  node id
+	key	  network key, or Ed25519 public key if pub is 1
+	pub	  1 for Ed25519 public key, 0 for network key
+	notbefore time from which the key is valid, nanoseconds since
+		  Unix epoch, or 0
+	notafter  time when the key expires, or 0
 
 table jobs:
 	id	job id
-	period	period in seconds
+	client	id of client owning the job
+	period	period in seconds, 0 for one-shot jobs
 	start	offset in seconds; jobs run at Unix time N*period+start
+		(one-shot jobs run at Unix time start, or at once if 0)
 	capa	capacity (exact meaning TBD)
-	want	number of desired copies
+	want	number of desired copies (for one-shot jobs, runs left)
 	cmd	the check to run (space-separated string)
+	overrun	what the node does if the previous run is late
+	region	geolocation of nodes allowed to run the job, or NULL
 
-table running:
+table running (primary key job, node):
 	job	job id
 	node	node id
 
-table results:
+table acks:
+	node	node id
+	seq	highest sequence number of results from the node that have
+		been stored
+
+table repl (one row, id 1):
+	epoch	replication epoch, incremented when a standby takes over
+	active	1 if this server is active, 0 if standby
+
+table schema_version (one row):
+	version	number of schema migrations applied, see store.go
+
+table results (primary key node, job, start; indexed by job, start):
 	node	 id of node that ran the job
 	job	 id of job that generated the result
-	start	 time when the run started, nanoseconds since Unix epoch
+	start	 time when the run started, nanoseconds since Unix epoch,
+		 by the server's clock
 	duration overall time for this run, in nanoseconds
 	flags	 1 for error, mostly
 	result	 encoded ("%+q") string array of results
+	delay	 time the run waited to be started, in nanoseconds
+	skew	 node's clock minus server's, in nanoseconds, 0 if unknown;
+		 start + skew is the start by the node's clock
 */
+var dbfile = "benchsrv.db"
+
 const (
-	dbfile        = "benchsrv.db"
 	dbCreateNodes = `CREATE TABLE IF NOT EXISTS nodes
 		(id integer primary key, last integer, capa integer,
-		loc integer, key blob[32])`
+		loc integer, key blob[32], pub blob[32], caps text,
+		client integer)`
 	dbCreateJobs = `CREATE TABLE IF NOT EXISTS jobs
 		(id integer primary key, period integer, start integer,
-		capa integer, want integer, cmd string)`
+		capa integer, want integer, cmd string, overrun integer,
+		region integer, client integer)`
 	dbCreateRunning = `CREATE TABLE IF NOT EXISTS running
 		(job integer, node integer)`
 	dbCreateResults = `CREATE TABLE IF NOT EXISTS results
 		(node integer, job integer, start integer, duration integer,
-		flags integer, err text, result text)`
-	dbSelectNodes   = "SELECT id, last, capa, loc, key FROM nodes"
-	dbInsertNode    = "INSERT OR REPLACE INTO nodes (id, last, capa, loc, key) VALUES (?, ?, ?, ?, ?)"
+		flags integer, err text, result text, delay integer,
+		skew integer)`
+	dbCreateKeys = `CREATE TABLE IF NOT EXISTS keys
+		(node integer, key blob[32], pub integer,
+		notbefore integer, notafter integer)`
+	dbMoveKeys = `INSERT INTO keys (node, key, pub, notbefore, notafter)
+		SELECT id, coalesce(pub, key), pub IS NOT NULL, 0, 0
+		FROM nodes WHERE length(coalesce(pub, key)) = 32`
+	dbClearKeys     = "UPDATE nodes SET key=NULL, pub=NULL"
+	dbSelectNodes   = "SELECT id, coalesce(client, 0), last, capa, loc, caps FROM nodes"
+	dbInsertNode    = "INSERT INTO nodes (id, client, last, capa, loc, caps) VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT (id) DO UPDATE SET client=excluded.client, last=excluded.last, capa=excluded.capa, loc=excluded.loc, caps=excluded.caps"
 	dbDeleteNode    = "DELETE FROM nodes WHERE id=?"
-	dbSelectJobs    = "SELECT id, period, start, capa, want, cmd FROM jobs"
-	dbInsertJob     = "INSERT OR REPLACE INTO jobs (id, period, start, capa, want, cmd) VALUES (?, ?, ?, ?, ?, ?)"
+	dbSelectKeys    = "SELECT node, key, pub, notbefore, notafter FROM keys ORDER BY rowid"
+	dbInsertKey     = "INSERT INTO keys (node, key, pub, notbefore, notafter) VALUES (?, ?, ?, ?, ?)"
+	dbDeleteKeys    = "DELETE FROM keys WHERE node=?"
+	dbSelectJobs    = "SELECT id, coalesce(client, 0), period, start, capa, want, cmd, overrun, region FROM jobs"
+	dbInsertJob     = "INSERT INTO jobs (id, client, period, start, capa, want, cmd, overrun, region) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT (id) DO UPDATE SET client=excluded.client, period=excluded.period, start=excluded.start, capa=excluded.capa, want=excluded.want, cmd=excluded.cmd, overrun=excluded.overrun, region=excluded.region"
 	dbDeleteJob     = "DELETE FROM jobs WHERE id=?"
 	dbSelectRunning = "SELECT job, node FROM running"
-	dbInsertRunning = "INSERT OR REPLACE INTO running (job, node) VALUES (?, ?)"
+	dbInsertRunning = "INSERT INTO running (job, node) VALUES (?, ?) ON CONFLICT (job, node) DO NOTHING"
 	dbDeleteRunning = "DELETE FROM running WHERE job=? AND node=?"
-	dbInsertResult  = "INSERT OR REPLACE INTO results (node, job, start, duration, flags, err, result) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	dbInsertResult  = "INSERT INTO results (node, job, start, duration, flags, err, result, delay, skew) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT (node, job, start) DO NOTHING"
+	dbSelectJobRes  = `SELECT node, start, duration, flags, err, result
+		FROM results WHERE job=? ORDER BY start, node`
+	dbCreateAcks = `CREATE TABLE IF NOT EXISTS acks
+		(node integer primary key, seq integer)`
+	dbSelectAcks = "SELECT node, seq FROM acks"
+	dbUpdateAck  = `INSERT INTO acks (node, seq) VALUES (?, ?)
+		ON CONFLICT (node) DO UPDATE SET seq=excluded.seq
+		WHERE acks.seq < excluded.seq`
+	dbDeleteAck = "DELETE FROM acks WHERE node=?"
+
+	dbCreateClients = `CREATE TABLE IF NOT EXISTS clients
+		(id integer primary key, name text)`
+	dbDefaultClient = "INSERT INTO clients (id, name) VALUES (0, 'default') ON CONFLICT (id) DO NOTHING"
+	dbSelectClients = "SELECT id, name, key FROM clients"
+	dbInsertClient  = "INSERT INTO clients (id, name, key) VALUES (?, ?, ?) ON CONFLICT (id) DO UPDATE SET name=excluded.name, key=excluded.key"
+	dbDeleteClient  = "DELETE FROM clients WHERE id=?"
+
+	dbCreateRepl = `CREATE TABLE IF NOT EXISTS repl
+		(id integer primary key, epoch integer, active integer)`
+	dbSelectRepl = "SELECT epoch, active FROM repl WHERE id=1"
+	dbSelectRole = "SELECT active FROM repl WHERE id=1"
+
+	dbSelectLatest   = "SELECT node, max(start) FROM results GROUP BY node"
+	dbSelectResNodes = "SELECT DISTINCT node FROM results"
+	dbSelectNodeRes  = `SELECT job, start, duration, flags, coalesce(err, ''),
+		result, coalesce(delay, 0), coalesce(skew, 0) FROM results
+		WHERE node=? AND start >= ? ORDER BY start LIMIT ?`
+	dbUpdateRepl = `INSERT INTO repl (id, epoch, active) VALUES (1, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET epoch=excluded.epoch,
+		active=excluded.active`
 )
 
+// statements clearing all state but results, before a standby loads
+// a snapshot from the active server
+var dbClearState = []string{
+	"DELETE FROM clients",
+	"DELETE FROM nodes",
+	"DELETE FROM keys",
+	"DELETE FROM jobs",
+	"DELETE FROM running",
+	"DELETE FROM acks",
+}
+
+// columns added to tables created by versions before schema migrations
+var dbAddColumns = []string{
+	"ALTER TABLE nodes ADD COLUMN pub blob[32]",
+	"ALTER TABLE nodes ADD COLUMN caps text",
+	"ALTER TABLE nodes ADD COLUMN client integer",
+	"ALTER TABLE jobs ADD COLUMN overrun integer DEFAULT 0",
+	"ALTER TABLE jobs ADD COLUMN region integer",
+	"ALTER TABLE jobs ADD COLUMN client integer",
+	"ALTER TABLE results ADD COLUMN delay integer DEFAULT 0",
+	"ALTER TABLE results ADD COLUMN skew integer",
+}
+
 type (
 	jobNotFoundError  uint64
 	nodeNotFoundError uint64
@@ -96,25 +202,21 @@ func (e nodeNotFoundError) Error() string {
 
 func dbOpen() error {
 	var err error
-	dbc, err = stdb.Open("sqlite3", dbfile)
+	dbc, err = stdb.Open(store.driver(), dbfile)
 	if err != nil {
 		return err
 	}
-	for _, v := range []string{
-		dbCreateJobs,
-		dbCreateNodes,
-		dbCreateRunning,
-		dbCreateResults,
-	} {
-		if _, err = dbc.Exec(v); err != nil {
-			return err
-		}
-	}
-	return nil
+	return dbc.Migrate(store.migrations(), log.Info)
 }
 
+// dbLoad loads the state from the database.
 func dbLoad() error {
-	for _, f := range []func() error{loadNodes, loadJobs, loadRunning} {
+	return store.load()
+}
+
+func (sqlStorage) load() error {
+	for _, f := range []func() error{loadClients, loadNodes, loadKeys,
+		loadAcks, loadJobs, loadRunning} {
 		if err := f(); err != nil {
 			return err
 		}
@@ -129,6 +231,24 @@ func dbClose() error {
 	return nil
 }
 
+func loadClients() error {
+	rows, err := dbc.Query(dbSelectClients)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	clients = nil
+	for rows.Next() {
+		var c client
+		if err := rows.Scan(&c.id, &c.name, &c.key); err != nil {
+			return err
+		}
+		clients = append(clients, &c)
+	}
+	sort.Sort(clients)
+	return nil
+}
+
 func loadNodes() error {
 	rows, err := dbc.Query(dbSelectNodes)
 	if err != nil {
@@ -138,11 +258,16 @@ func loadNodes() error {
 	nodes = make([]*node, 0, 16)
 	for rows.Next() {
 		var (
-			n node
+			n    node
+			caps sql.NullString
 		)
-		if err := rows.Scan(&n.id, &n.lastSeen, &n.capa, &n.loc, &n.key); err != nil {
+		if err := rows.Scan(&n.id, &n.client, &n.lastSeen, &n.capa,
+			&n.loc, &caps); err != nil {
 			return err
 		}
+		if caps.Valid {
+			n.caps = strings.Fields(caps.String)
+		}
 		if nlen := len(nodes); nlen == cap(nodes) {
 			if nlen < 1<<13 { // 8*1024
 				nlen <<= 1
@@ -157,6 +282,51 @@ func loadNodes() error {
 	return nil
 }
 
+func loadKeys() error {
+	rows, err := dbc.Query(dbSelectKeys)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id uint64
+			k  nodeKey
+		)
+		if err := rows.Scan(&id, &k.key, &k.pub, &k.notBefore,
+			&k.notAfter); err != nil {
+			return err
+		}
+		n := nodes.find(id)
+		if n == nil {
+			return nodeNotFoundError(id)
+		}
+		n.keys = append(n.keys, k)
+	}
+	return nil
+}
+
+func loadAcks() error {
+	rows, err := dbc.Query(dbSelectAcks)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id  uint64
+			seq int64
+		)
+		if err := rows.Scan(&id, &seq); err != nil {
+			return err
+		}
+		if n := nodes.find(id); n != nil {
+			n.acked, n.seen = seq, seq
+		}
+	}
+	return nil
+}
+
 func loadJobs() error {
 	rows, err := dbc.Query(dbSelectJobs)
 	if err != nil {
@@ -166,14 +336,16 @@ func loadJobs() error {
 	jobs = make([]*job, 0, 16)
 	for rows.Next() {
 		var (
-			j    job
-			want int
-			s    string
+			j      job
+			want   int
+			s      string
+			region sql.NullInt64
 		)
-		if err := rows.Scan(&j.Id, &j.Period, &j.Start, &j.capa,
-			&want, &s); err != nil {
+		if err := rows.Scan(&j.Id, &j.client, &j.Period, &j.Start,
+			&j.capa, &want, &s, &j.Overrun, &region); err != nil {
 			return err
 		}
+		j.region, j.local = geoloc(region.Int64), region.Valid
 		j.Check = strings.Fields(s)
 		j.nodes = make([]uint64, 0, want)
 		jobs = append(jobs, &j)
@@ -206,57 +378,324 @@ func loadRunning() error {
 	return nil
 }
 
-func dbCommit(diffs difflist, results reslist, done chan<- bool) {
+// dbCommit commits diffs and results and sends the error, if any,
+// to done.
+func dbCommit(diffs difflist, results reslist, done chan<- error) {
 	log.Debug("commit starting")
-	defer func() {
-		log.Debug("commit done")
-		done <- true
-	}()
+	err := store.commit(diffs, results)
+	log.Debug("commit done")
+	done <- err
+}
+
+// commit commits diffs and results in one transaction, along with
+// the highest sequence number of results from each node.
+func (sqlStorage) commit(diffs difflist, results reslist) (err error) {
 	tx, err := dbc.Begin()
 	if err != nil {
 		log.Notice("sql.Begin: " + err.Error())
 		return
 	}
+	// fencing: the server may have stepped down since the commit
+	// started
+	var active bool
+	if err = tx.QueryRow(dbSelectRole).Scan(&active); err == nil &&
+		!active {
+		err = errStandby
+	}
+	if err != nil {
+		log.Notice("commit: " + err.Error())
+		rollback(tx)
+		return
+	}
+	now := clk.Now().UnixNano()
+	if err = dbApply(tx, diffs, results, now); err != nil {
+		log.Notice("sql.Exec: " + err.Error())
+		rollback(tx)
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		log.Notice("sql.Commit: " + err.Error())
+		return
+	}
+	expired(now)
+	return
+}
+
+// dbApply performs diffs and stores results in tx, along with the
+// highest sequence number of results from each node, rolls up newly
+// stored results and expires old ones as of now, see expire.
+func dbApply(tx *stdb.Tx, diffs difflist, results reslist, now int64) error {
+	var err error
 	for _, v := range diffs {
 		switch v.op {
 		case opAddLink:
+			// the link may be sent again to a standby
 			_, err = tx.Exec(dbInsertRunning, v.jobId, v.nodeId)
 		case opRmLink:
 			_, err = tx.Exec(dbDeleteRunning, v.jobId, v.nodeId)
 		case opAddNode:
-			_, err = tx.Exec(dbInsertNode, v.n.id, v.n.lastSeen,
-				v.n.capa, v.n.loc, []byte(v.n.key))
+			var caps interface{}
+			if v.n.caps != nil {
+				caps = strings.Join(v.n.caps, " ")
+			}
+			_, err = tx.Exec(dbInsertNode, v.n.id, v.n.client,
+				v.n.lastSeen, v.n.capa, v.n.loc, caps)
+			if err == nil {
+				err = insertKeys(tx, v.n)
+			}
 		case opRmNode:
-			_, err = tx.Exec(dbDeleteNode, v.nodeId)
+			for _, s := range []string{dbDeleteNode, dbDeleteKeys,
+				dbDeleteAck} {
+				if _, err = tx.Exec(s, v.nodeId); err != nil {
+					break
+				}
+			}
 		case opAddJob:
-			_, err = tx.Exec(dbInsertJob, v.j.Id, v.j.Period,
-				v.j.Start, v.j.capa, cap(v.j.nodes),
-				strings.Join(v.j.Check, " "))
+			var region interface{}
+			if v.j.local {
+				region = int64(v.j.region)
+			}
+			_, err = tx.Exec(dbInsertJob, v.j.Id, v.j.client,
+				v.j.Period, v.j.Start, v.j.capa, cap(v.j.nodes),
+				strings.Join(v.j.Check, " "), v.j.Overrun, region)
 		case opRmJob:
 			_, err = tx.Exec(dbDeleteJob, v.jobId)
+		case opAddClient:
+			var key interface{}
+			if len(v.c.key) != 0 {
+				key = []byte(v.c.key)
+			}
+			_, err = tx.Exec(dbInsertClient, v.c.id, v.c.name, key)
+		case opRmClient:
+			_, err = tx.Exec(dbDeleteClient, v.clientId)
 		default:
 			log.Warning(fmt.Sprintf("interal error: invalid database operation %d", v.op))
 		}
 		if err != nil {
-			log.Notice("sql.Exec: %v" + err.Error())
-			if err = tx.Rollback(); err != nil {
-				log.Notice("sql.Rollback: " + err.Error())
-			}
-			return
+			return err
 		}
 	}
-	for _, v := range results {
-		_, err := tx.Exec(dbInsertResult, v.nodeId, v.JobId, v.Start,
-			v.RT, v.Flags, v.Errs, fmt.Sprintf("%+q", v.S))
+	acked := make(map[uint64]int64)
+	ru := make(rollups)
+	for i, v := range results {
+		r, err := tx.Exec(dbInsertResult, v.nodeId, v.JobId, v.Start,
+			v.RT, v.Flags, v.Errs, fmt.Sprintf("%+q", v.S), v.Delay,
+			v.Skew)
 		if err != nil {
-			log.Notice("sql.Exec: " + err.Error())
-			if err = tx.Rollback(); err != nil {
-				log.Notice("sql.Rollback: " + err.Error())
+			return err
+		}
+		n, err := r.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n != 0 { // not a retransmission
+			ru.add(&results[i])
+		}
+		if v.Seq > acked[v.nodeId] {
+			acked[v.nodeId] = v.Seq
+		}
+	}
+	if err = ru.store(tx); err != nil {
+		return err
+	}
+	if err = expire(tx, now); err != nil {
+		return err
+	}
+	return updateAcks(tx, acked)
+}
+
+// updateAcks raises the highest sequence numbers of results stored
+// from nodes to those in acked.
+func updateAcks(tx *stdb.Tx, acked map[uint64]int64) error {
+	for id, seq := range acked {
+		if _, err := tx.Exec(dbUpdateAck, id, seq); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dbReplicate stores a batch received from the active server.  A
+// snapshot replaces all state but results.
+func dbReplicate(reset bool, diffs difflist, results reslist,
+	acked map[uint64]int64) error {
+	return store.replicate(reset, diffs, results, acked)
+}
+
+func (sqlStorage) replicate(reset bool, diffs difflist, results reslist,
+	acked map[uint64]int64) error {
+	tx, err := dbc.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nop if committed
+	if reset {
+		for _, v := range dbClearState {
+			if _, err = tx.Exec(v); err != nil {
+				return err
 			}
-			return
 		}
 	}
+	now := clk.Now().UnixNano()
+	if err = dbApply(tx, diffs, results, now); err != nil {
+		return err
+	}
+	if err = updateAcks(tx, acked); err != nil {
+		return err
+	}
 	if err = tx.Commit(); err != nil {
-		log.Notice("sql.Commit: " + err.Error())
+		return err
+	}
+	expired(now)
+	return nil
+}
+
+// loadLatest returns the start of the latest result stored from each
+// node.
+func loadLatest() (map[uint64]int64, error) {
+	rows, err := dbc.Query(dbSelectLatest)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	m := make(map[uint64]int64)
+	for rows.Next() {
+		var (
+			id    uint64
+			start int64
+		)
+		if err := rows.Scan(&id, &start); err != nil {
+			return nil, err
+		}
+		m[id] = start
+	}
+	return m, nil
+}
+
+// loadResultNodes returns ids of nodes having results stored.
+func loadResultNodes() ([]uint64, error) {
+	rows, err := dbc.Query(dbSelectResNodes)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var a []uint64
+	for rows.Next() {
+		var id uint64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		a = append(a, id)
+	}
+	return a, nil
+}
+
+// loadNodeResults returns up to max results of node id started at or
+// after from, by start.  Seq is not stored, and is 0.
+func loadNodeResults(id uint64, from int64, max int) (reslist, error) {
+	rows, err := dbc.Query(dbSelectNodeRes, id, from, max)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var l reslist
+	for rows.Next() {
+		var (
+			r = result{nodeId: id}
+			s string
+		)
+		if err := rows.Scan(&r.JobId, &r.Start, &r.RT, &r.Flags,
+			&r.Errs, &s, &r.Delay, &r.Skew); err != nil {
+			return nil, err
+		}
+		if r.S, err = parseResult(s); err != nil {
+			return nil, err
+		}
+		l = append(l, r)
+	}
+	return l, nil
+}
+
+// parseResult decodes the result column, a "%+q" encoded string array.
+func parseResult(s string) ([]string, error) {
+	if len(s) < 2 || s[0] != '[' || s[len(s)-1] != ']' {
+		return nil, fmt.Errorf("invalid result %q", s)
+	}
+	var a []string
+	for s = s[1 : len(s)-1]; s != ""; {
+		q, err := strconv.QuotedPrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid result %q", s)
+		}
+		v, _ := strconv.Unquote(q) // QuotedPrefix checked it
+		a = append(a, v)
+		s = strings.TrimPrefix(s[len(q):], " ")
+	}
+	return a, nil
+}
+
+// loadRepl returns the replication epoch and whether the server is
+// active, or standby if no role is stored yet.
+func loadRepl(standby bool) (uint64, bool, error) {
+	var (
+		epoch  uint64
+		active bool
+	)
+	err := dbc.QueryRow(dbSelectRepl).Scan(&epoch, &active)
+	if err == sql.ErrNoRows {
+		return 0, !standby, nil
+	}
+	return epoch, active, err
+}
+
+// saveRepl stores the replication epoch and role.
+func saveRepl(epoch uint64, active bool) error {
+	_, err := dbc.Exec(dbUpdateRepl, epoch, active)
+	return err
+}
+
+func rollback(tx *stdb.Tx) {
+	if err := tx.Rollback(); err != nil {
+		log.Notice("sql.Rollback: " + err.Error())
+	}
+}
+
+// insertKeys replaces keys of n in the database.
+func insertKeys(tx *stdb.Tx, n *node) error {
+	if _, err := tx.Exec(dbDeleteKeys, n.id); err != nil {
+		return err
+	}
+	for _, k := range n.keys {
+		if _, err := tx.Exec(dbInsertKey, n.id, []byte(k.key), k.pub,
+			k.notBefore, k.notAfter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadJobResults returns committed results of job id, one per line.
+func loadJobResults(id uint64) ([]string, error) {
+	rows, err := dbc.Query(dbSelectJobRes, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var a []string
+	for rows.Next() {
+		var (
+			node         uint64
+			start, rt    int64
+			flags        int
+			errs, result string
+		)
+		if err := rows.Scan(&node, &start, &rt, &flags, &errs,
+			&result); err != nil {
+			return nil, err
+		}
+		a = append(a, fmt.Sprintf("node %d start %s rt %v flags %d err %q result %s",
+			node, time.Unix(0, start).UTC().Format(time.RFC3339),
+			time.Duration(rt), flags, errs, result))
 	}
+	return a, nil
 }
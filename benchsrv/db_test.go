@@ -0,0 +1,89 @@
+// Benchnet
+//
+// Copyright 2012 Vadim Vygonets
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"database/sql"
+	"io"
+	"path/filepath"
+	"testing"
+)
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+// schema and data of a database created by the first version
+var baselineDB = []string{
+	`CREATE TABLE nodes (id integer primary key, last integer,
+		capa integer, loc integer, key blob[32])`,
+	`CREATE TABLE jobs (id integer primary key, period integer,
+		start integer, capa integer, want integer, cmd string)`,
+	"CREATE TABLE running (job integer, node integer)",
+	`CREATE TABLE results (node integer, job integer, start integer,
+		duration integer, flags integer, err text, result text)`,
+	"INSERT INTO nodes VALUES (5, 0, 10, 0, zeroblob(32))",
+	"INSERT INTO jobs VALUES (9, 60, 0, 1, 1, 'dns example.com')",
+	"INSERT INTO running VALUES (9, 5)",
+	"INSERT INTO results VALUES (5, 9, 100, 1000, 0, '', '[]')",
+	"INSERT INTO results VALUES (5, 9, 100, 1000, 0, '', '[]')",
+}
+
+func TestMigrateBaseline(t *testing.T) {
+	log = &fileLogger{w: nopCloser{io.Discard}}
+	store = sqliteStorage{}
+	dbfile = filepath.Join(t.TempDir(), "benchsrv.db")
+	db, err := sql.Open("sqlite3", dbfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range baselineDB {
+		if _, err = db.Exec(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+	for i := 0; i < 2; i++ { // migrate, then open migrated
+		if err = dbOpen(); err != nil {
+			t.Fatalf("open %d: %v", i, err)
+		}
+		if err = dbLoad(); err != nil {
+			t.Fatalf("load %d: %v", i, err)
+		}
+		if len(nodes) != 1 || len(jobs) != 1 {
+			t.Fatalf("got %d nodes, %d jobs, want 1, 1",
+				len(nodes), len(jobs))
+		}
+		n, j := nodes[0], jobs[0]
+		if len(n.keys) != 1 || len(n.keys[0].key) != 32 ||
+			n.keys[0].pub {
+			t.Errorf("node keys %+v, want one network key", n.keys)
+		}
+		if len(n.jobs) != 1 || n.jobs[0].Id != j.Id {
+			t.Errorf("node jobs %v, want job 9", n.jobs)
+		}
+		if j.Overrun != 0 || j.local {
+			t.Errorf("job overrun %d, local %v, want 0, false",
+				j.Overrun, j.local)
+		}
+		a, err := loadJobResults(9)
+		if err != nil || len(a) != 1 {
+			t.Errorf("results %q, %v, want 1 deduplicated", a, err)
+		}
+		dbClose()
+	}
+}
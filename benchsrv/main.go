@@ -17,17 +17,82 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"github.com/unixdj/benchnet/lib/clock"
 	"github.com/unixdj/benchnet/lib/conn"
-	"log/syslog"
+	"io/ioutil"
 	"net"
 	"os"
 	"os/signal"
 	"syscall"
 )
 
-var log *syslog.Writer
+var log logger
 var dying bool
+var clk = clock.Real
+
+// TLS certificate and key, PEM encoded.  If present, the server
+// also accepts node connections over TLS and WebSocket.
+var (
+	tlsCert = "benchsrv.crt"
+	tlsKey  = "benchsrv.key"
+)
+
+// Ed25519 private key seed, hexadecimal.  Generated on first start.
+var serverKeyFile = "benchsrv.ed25519"
+
+var serverKey ed25519.PrivateKey
+
+// loadServerKey loads the server's Ed25519 key, generating it if
+// the file doesn't exist.
+func loadServerKey() error {
+	var seed []byte
+	buf, err := ioutil.ReadFile(serverKeyFile)
+	switch {
+	case os.IsNotExist(err):
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		seed = priv.Seed()
+		err = ioutil.WriteFile(serverKeyFile,
+			[]byte(fmt.Sprintf("%x\n", seed)), 0600)
+		if err != nil {
+			return err
+		}
+		log.Notice("generated new key in " + serverKeyFile)
+	case err != nil:
+		return err
+	default:
+		if _, err := fmt.Sscanf(string(buf), "%x", &seed); err != nil ||
+			len(seed) != ed25519.SeedSize {
+			return errors.New(serverKeyFile + ": invalid key")
+		}
+	}
+	serverKey = ed25519.NewKeyFromSeed(seed)
+	log.Info(fmt.Sprintf("public key ed25519:%x", serverKey.Public()))
+	return nil
+}
+
+// loadTLS loads the TLS certificate, returning nil if the certificate
+// file doesn't exist.
+func loadTLS() (*tls.Config, error) {
+	if _, err := os.Stat(tlsCert); os.IsNotExist(err) {
+		log.Info("no TLS certificate, not listening for TLS and WebSocket")
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
+	if err != nil {
+		return nil, err
+	}
+	log.Info(fmt.Sprintf("TLS certificate fingerprint %x",
+		conn.Fingerprint(cert.Certificate[0])))
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
 
 func netLoop(l net.Listener, handler func(net.Conn), name string) {
 	for {
@@ -50,12 +115,39 @@ func netLoop(l net.Listener, handler func(net.Conn), name string) {
 	}
 }
 
+// listen starts listening on addr, unless it's "off", and runs
+// netLoop.  With config, it listens for TLS connections.
+func listen(addr string, config *tls.Config, handler func(net.Conn),
+	name string) (net.Listener, error) {
+	if addr == "off" {
+		log.Info("not listening for " + name + " connections")
+		return nil, nil
+	}
+	var (
+		l   net.Listener
+		err error
+	)
+	if config != nil {
+		l, err = tls.Listen("tcp", addr, config)
+	} else {
+		l, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	go netLoop(l, handler, name)
+	return l, nil
+}
+
 func main() {
+	if err := readConf(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 	var err error
-	log, err = syslog.New(syslog.LOG_DAEMON,
-		fmt.Sprintf("benchnet.server[%d]", os.Getpid()))
+	log, err = openLog()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "can't connect to syslog: %v\n", err)
+		fmt.Fprintf(os.Stderr, "can't open log: %v\n", err)
 		os.Exit(1)
 	}
 	defer log.Close()
@@ -64,6 +156,12 @@ func main() {
 	signal.Notify(killme, syscall.SIGHUP, syscall.SIGINT, syscall.SIGQUIT,
 		syscall.SIGPIPE, syscall.SIGTERM)
 
+	if err := loadServerKey(); err != nil {
+		log.Err("FATAL: " + err.Error())
+		return
+	}
+	initProto()
+
 	initDone := make(chan error)
 	killData := make(chan bool, 1) // async
 	dataDone := make(chan bool)
@@ -78,21 +176,62 @@ func main() {
 		<-dataDone
 	}()
 
-	l, err := net.Listen("tcp", conn.Port)
+	l, err := listen(listenAddr, nil, handle, "client")
+	if err != nil {
+		log.Err("FATAL: " + err.Error())
+		return
+	}
+	if l != nil {
+		defer l.Close()
+	}
+
+	config, err := loadTLS()
+	if err != nil {
+		log.Err("FATAL: " + err.Error())
+		return
+	}
+	if config != nil {
+		t, err := listen(tlsAddr, config, handle, "TLS client")
+		if err != nil {
+			log.Err("FATAL: " + err.Error())
+			return
+		}
+		if t != nil {
+			defer t.Close()
+		}
+		// port 443 is privileged, carry on without it
+		w, err := listen(wsAddr, config, handleWS, "WebSocket client")
+		if err != nil {
+			log.Err("can't listen for WebSocket: " + err.Error())
+		} else if w != nil {
+			defer w.Close()
+		}
+	}
+
+	r, err := listen(replAddr, nil, replHandle, "replication")
 	if err != nil {
 		log.Err("FATAL: " + err.Error())
 		return
 	}
-	defer l.Close()
-	go netLoop(l, handle, "client")
+	if r != nil {
+		defer r.Close()
+	}
+	if peerAddr != "" {
+		go replDial()
+	}
 
-	m, err := net.Listen("tcp", "127.0.0.1:25197") // "bm" for benchmgmt
+	if mgmtKey == nil && mgmtAddr != "off" {
+		log.Warning("no mgmtkey, not listening for management connections")
+		mgmtAddr = "off"
+	}
+	m, err := listen(mgmtAddr, nil, mgmtHandle, "management")
 	if err != nil {
 		log.Err("FATAL: " + err.Error())
 		return
 	}
-	defer m.Close()
-	go netLoop(m, mgmtHandle, "management")
+	if m != nil {
+		defer m.Close()
+	}
 
 	log.Info("RUNNING")
 
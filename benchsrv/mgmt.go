@@ -18,29 +18,118 @@ package main
 
 import (
 	"crypto/rand"
+	"crypto/subtle"
 	"fmt"
 	"github.com/unixdj/smtplike"
 	"io"
 	"net"
 	"regexp" // i'm so lazy
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 var netKeyRE = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
 
+// Time for which older keys of a node stay valid after a new key is
+// added, so that the node can pick up the new key.
+const defaultOverlap = 7 * 24 * time.Hour
+
+// parseKey parses a shared key or "ed25519:" followed by a public
+// key.  ok is false if s looks like neither.
+func parseKey(s string) (k nodeKey, ok bool) {
+	if strings.HasPrefix(s, "ed25519:") {
+		s, k.pub = s[8:], true
+	}
+	if !netKeyRE.MatchString(s) {
+		return k, false
+	}
+	fmt.Sscanf(s, "%x", &k.key)
+	return k, true
+}
+
+// randomKey generates a shared key.
+func randomKey() (nodeKey, error) {
+	k := nodeKey{key: make([]byte, 32)}
+	_, err := io.ReadFull(rand.Reader, k.key)
+	return k, err
+}
+
+// mgmtKey is the administrator's key, see mgmtAuth.
+var mgmtKey []byte
+
+// mgmtSession is the state of a management connection.  A session
+// authenticates with the administrator's key or a client's key, see
+// mgmtAuth.  A session scoped to a client sees only nodes and jobs of
+// that client.  Nodes and jobs are created for the session's client,
+// client 0 if none.
+type mgmtSession struct {
+	client uint64 // client the session acts for
+	scoped bool   // client is set, see mgmtAuth and mgmtClient
+	admin  bool   // authenticated with mgmtKey
+	peer   string // remote address
+}
+
+// Reply to commands not allowed in sessions scoped to a client
+const scopedMsg = "not allowed in a session scoped to a client"
+
+// Reply to commands before authentication
+const authMsg = "authenticate first"
+
+// Reply to commands changing state on a standby
+const standbyMsg = "not allowed on a standby server"
+
+// handler is a management command handler.
+type handler func(args []string, c *smtplike.Conn) (int, string)
+
+// active wraps h to refuse while the server is a standby.
+func active(h handler) handler {
+	return func(args []string, c *smtplike.Conn) (int, string) {
+		if isStandby() {
+			return 550, standbyMsg
+		}
+		return h(args, c)
+	}
+}
+
+// authed wraps h to refuse until s has authenticated.
+func (s *mgmtSession) authed(h handler) handler {
+	return func(args []string, c *smtplike.Conn) (int, string) {
+		if !s.admin && !s.scoped {
+			return 530, authMsg
+		}
+		return h(args, c)
+	}
+}
+
+// owns checks if s may see nodes or jobs of client id.
+func (s *mgmtSession) owns(id uint64) bool {
+	return !s.scoped || s.client == id
+}
+
 func mgmtGreet(args []string, c *smtplike.Conn) (int, string) {
 	return smtplike.Hello, "benchnet-management-0 hello"
 }
 
-func mgmtAddJob(args []string, c *smtplike.Conn) (int, string) {
-	if len(args) < 6 {
-		return 501, "invalid syntax"
-	}
+func (s *mgmtSession) mgmtAddJob(args []string, c *smtplike.Conn) (int, string) {
 	var (
 		j   job
 		tmp int64
 		err error
 	)
+	if len(args) > 0 {
+		for i, v := range overrunNames {
+			if args[0] == v {
+				j.Overrun = i
+				args = args[1:]
+				break
+			}
+		}
+	}
+	if len(args) < 6 {
+		return 501, "invalid syntax"
+	}
 	if j.Id, err = strconv.ParseUint(args[0], 0, 64); err != nil {
 		return 501, args[0] + ": " + err.Error()
 	}
@@ -61,6 +150,7 @@ func mgmtAddJob(args []string, c *smtplike.Conn) (int, string) {
 	}
 	j.nodes = make([]uint64, 0, int(tmp))
 	j.Check = args[5:]
+	j.client = s.client
 	if jp := getJob(j.Id); jp != nil {
 		return 550, "job already exists"
 	}
@@ -68,7 +158,83 @@ func mgmtAddJob(args []string, c *smtplike.Conn) (int, string) {
 	return 200, "ok"
 }
 
-func mgmtRmJob(args []string, c *smtplike.Conn) (int, string) {
+// parseNodeList parses comma-separated node IDs.
+func parseNodeList(s string) ([]uint64, error) {
+	var ids []uint64
+	for _, v := range strings.Split(s, ",") {
+		id, err := strconv.ParseUint(v, 0, 64)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (s *mgmtSession) mgmtAddOnce(args []string, c *smtplike.Conn) (int, string) {
+	if len(args) < 5 {
+		return 501, "invalid syntax"
+	}
+	var (
+		j   job
+		ids []uint64
+		tmp int64
+		err error
+	)
+	if j.Id, err = strconv.ParseUint(args[0], 0, 64); err != nil {
+		return 501, args[0] + ": " + err.Error()
+	}
+	if tmp, err = strconv.ParseInt(args[1], 0, 64); err != nil {
+		return 501, args[1] + ": " + err.Error()
+	}
+	j.Start = int(tmp)
+	if tmp, err = strconv.ParseInt(args[2], 0, 32); err != nil {
+		return 501, args[2] + ": " + err.Error()
+	}
+	j.capa = int(tmp)
+	switch where := args[3]; {
+	case strings.HasPrefix(where, "nodes:"):
+		if ids, err = parseNodeList(where[6:]); err != nil {
+			return 501, where + ": " + err.Error()
+		}
+		for _, id := range ids {
+			n := getNode(id)
+			if n == nil || !s.owns(n.client) {
+				return 550, nodeNotFoundError(id).Error()
+			}
+			if n.client != s.client {
+				return 550, fmt.Sprintf("node %d belongs to client %d",
+					id, n.client)
+			}
+		}
+		j.nodes = make([]uint64, 0, len(ids))
+	default:
+		if i := strings.IndexByte(where, '@'); i != -1 {
+			loc, err := strconv.ParseUint(where[i+1:], 0, 64)
+			if err != nil {
+				return 501, where + ": " + err.Error()
+			}
+			j.region, j.local = geoloc(loc), true
+			where = where[:i]
+		}
+		if tmp, err = strconv.ParseInt(where, 0, 32); err != nil {
+			return 501, args[3] + ": " + err.Error()
+		}
+		j.nodes = make([]uint64, 0, int(tmp))
+	}
+	j.Check = args[4:]
+	j.client = s.client
+	if jp := getJob(j.Id); jp != nil {
+		return 550, "job already exists"
+	}
+	addOnce(&j, ids)
+	if ids == nil {
+		requestSchedule()
+	}
+	return 200, "ok"
+}
+
+func (s *mgmtSession) mgmtResults(args []string, c *smtplike.Conn) (int, string) {
 	if len(args) != 1 {
 		return 501, "invalid syntax"
 	}
@@ -76,7 +242,62 @@ func mgmtRmJob(args []string, c *smtplike.Conn) (int, string) {
 	if err != nil {
 		return 501, args[0] + ": " + err.Error()
 	}
-	if j := getJob(id); j != nil {
+	if s.scoped {
+		if j := getJob(id); j == nil || j.client != s.client {
+			return 550, "job does not exist"
+		}
+	}
+	a, err := loadJobResults(id)
+	if err != nil {
+		return 451, err.Error()
+	}
+	if len(a) == 0 {
+		return 210, "no results"
+	}
+	return 210, strings.Join(a, "\n")
+}
+
+func (s *mgmtSession) mgmtRollup(args []string, c *smtplike.Conn) (int, string) {
+	if len(args) != 2 {
+		return 501, "invalid syntax"
+	}
+	id, err := strconv.ParseUint(args[0], 0, 64)
+	if err != nil {
+		return 501, args[0] + ": " + err.Error()
+	}
+	var period int64
+	switch args[1] {
+	case "hourly":
+		period = hourly
+	case "daily":
+		period = daily
+	default:
+		return 501, args[1] + ": must be hourly or daily"
+	}
+	if s.scoped {
+		if j := getJob(id); j == nil || j.client != s.client {
+			return 550, "job does not exist"
+		}
+	}
+	a, err := loadJobRollups(id, period)
+	if err != nil {
+		return 451, err.Error()
+	}
+	if len(a) == 0 {
+		return 210, "no rollups"
+	}
+	return 210, strings.Join(a, "\n")
+}
+
+func (s *mgmtSession) mgmtRmJob(args []string, c *smtplike.Conn) (int, string) {
+	if len(args) != 1 {
+		return 501, "invalid syntax"
+	}
+	id, err := strconv.ParseUint(args[0], 0, 64)
+	if err != nil {
+		return 501, args[0] + ": " + err.Error()
+	}
+	if j := getJob(id); j != nil && s.owns(j.client) {
 		rmJob(j)
 	} else {
 		return 550, "job does not exist"
@@ -84,7 +305,7 @@ func mgmtRmJob(args []string, c *smtplike.Conn) (int, string) {
 	return 200, "ok"
 }
 
-func mgmtAddNode(args []string, c *smtplike.Conn) (int, string) {
+func (s *mgmtSession) mgmtAddNode(args []string, c *smtplike.Conn) (int, string) {
 	if len(args) < 3 || len(args) > 4 {
 		return 501, "invalid syntax"
 	}
@@ -105,18 +326,19 @@ func mgmtAddNode(args []string, c *smtplike.Conn) (int, string) {
 	} else {
 		n.loc = geoloc(tmp)
 	}
-	n.key = make([]byte, 32)
+	var (
+		k  nodeKey
+		ok bool
+	)
 	if len(args) == 3 {
-		l, err := io.ReadFull(rand.Reader, n.key)
-		if l != len(n.key) || err != nil {
+		if k, err = randomKey(); err != nil {
 			return 501, "rand: " + err.Error()
 		}
-	} else {
-		if !netKeyRE.MatchString(args[3]) {
-			return 501, args[3] + ": must be 64 hexadecimal digits"
-		}
-		fmt.Sscanf(args[3], "%x", &n.key)
+	} else if k, ok = parseKey(args[3]); !ok {
+		return 501, args[3] + ": must be 64 hexadecimal digits"
 	}
+	n.keys = []nodeKey{k}
+	n.client = s.client
 	if np := getNode(n.id); np != nil {
 		return 550, "node already exists"
 	}
@@ -124,7 +346,7 @@ func mgmtAddNode(args []string, c *smtplike.Conn) (int, string) {
 	return 200, "ok"
 }
 
-func mgmtRmNode(args []string, c *smtplike.Conn) (int, string) {
+func (s *mgmtSession) mgmtRmNode(args []string, c *smtplike.Conn) (int, string) {
 	if len(args) != 1 {
 		return 501, "invalid syntax"
 	}
@@ -132,7 +354,7 @@ func mgmtRmNode(args []string, c *smtplike.Conn) (int, string) {
 	if err != nil {
 		return 501, args[0] + ": " + err.Error()
 	}
-	if n := getNode(id); n != nil {
+	if n := getNode(id); n != nil && s.owns(n.client) {
 		rmNode(n)
 	} else {
 		return 550, "node does not exist"
@@ -140,15 +362,191 @@ func mgmtRmNode(args []string, c *smtplike.Conn) (int, string) {
 	return 200, "ok"
 }
 
-func mgmtList(args []string, c *smtplike.Conn) (int, string) {
+func (s *mgmtSession) mgmtNewKey(args []string, c *smtplike.Conn) (int, string) {
+	if len(args) < 1 || len(args) > 3 {
+		return 501, "invalid syntax"
+	}
+	id, err := strconv.ParseUint(args[0], 0, 64)
+	if err != nil {
+		return 501, args[0] + ": " + err.Error()
+	}
+	var (
+		k       nodeKey
+		haveKey bool
+		overlap = defaultOverlap
+	)
+	for _, v := range args[1:] {
+		if tmp, ok := parseKey(v); ok && !haveKey {
+			k, haveKey = tmp, true
+		} else if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			overlap = d
+		} else {
+			return 501, v + ": neither key nor overlap"
+		}
+	}
+	if !haveKey {
+		if k, err = randomKey(); err != nil {
+			return 501, "rand: " + err.Error()
+		}
+	}
+	n := getNode(id)
+	if n == nil || !s.owns(n.client) {
+		return 550, "node does not exist"
+	}
+	now := clk.Now().UnixNano()
+	if keys := n.validKeys(now); len(keys) != 0 && keys[0].pub != k.pub &&
+		overlap != 0 {
+		// signatures differ in size, the server can't try both
+		return 550, "keys of different types can't overlap"
+	}
+	k.notBefore = now
+	addKey(id, k, now+int64(overlap))
+	return 210, k.String()
+}
+
+func mgmtPubKey(args []string, c *smtplike.Conn) (int, string) {
+	if len(args) != 0 {
+		return 501, "invalid syntax"
+	}
+	return 210, fmt.Sprintf("ed25519:%x", serverKey.Public())
+}
+
+func (s *mgmtSession) mgmtList(args []string, c *smtplike.Conn) (int, string) {
 	if len(args) != 0 {
 		return 501, "invalid syntax"
 	}
-	s := nodes.String() + jobs.String()
-	if len(s) >= 2 {
-		s = s[:len(s)-2]
+	var cl *client
+	if s.scoped {
+		cl = &client{id: s.client}
+	}
+	l := list(cl)
+	if len(l) >= 2 {
+		l = l[:len(l)-2]
+	}
+	return 210, l
+}
+
+// mgmtAuth authenticates the session with the administrator's key,
+// or with the key of a client, scoping the session to the client.
+func (s *mgmtSession) mgmtAuth(args []string, c *smtplike.Conn) (int, string) {
+	if len(args) != 1 {
+		return 501, "invalid syntax"
+	}
+	if s.admin || s.scoped {
+		return 503, "already authenticated"
+	}
+	k, ok := parseKey(args[0])
+	if !ok || k.pub {
+		return 501, "invalid key"
+	}
+	if subtle.ConstantTimeCompare(k.key, mgmtKey) == 1 {
+		s.admin = true
+		return 200, "ok"
+	}
+	if id, ok := findKey(k.key); ok {
+		s.client, s.scoped = id, true
+		return 200, fmt.Sprintf("client %d", id)
+	}
+	log.Notice("management authentication failed from " + s.peer)
+	return 535, "authentication failed"
+}
+
+// mgmtClient shows the client of the session, or scopes the session
+// of the administrator to a client.  A scoped session stays scoped.
+func (s *mgmtSession) mgmtClient(args []string, c *smtplike.Conn) (int, string) {
+	if len(args) > 1 {
+		return 501, "invalid syntax"
+	}
+	if len(args) == 0 {
+		if !s.scoped {
+			return 210, "no client"
+		}
+		return 210, fmt.Sprintf("client %d", s.client)
+	}
+	id, err := strconv.ParseUint(args[0], 0, 64)
+	if err != nil {
+		return 501, args[0] + ": " + err.Error()
+	}
+	if s.scoped && id != s.client {
+		return 550, fmt.Sprintf("session is scoped to client %d", s.client)
+	}
+	if getClient(id) == nil {
+		return 550, "client does not exist"
+	}
+	s.client, s.scoped = id, true
+	return 200, "ok"
+}
+
+func (s *mgmtSession) mgmtAddClient(args []string, c *smtplike.Conn) (int, string) {
+	if len(args) < 2 {
+		return 501, "invalid syntax"
+	}
+	if s.scoped {
+		return 550, scopedMsg
+	}
+	id, err := strconv.ParseUint(args[0], 0, 64)
+	if err != nil {
+		return 501, args[0] + ": " + err.Error()
+	}
+	if getClient(id) != nil {
+		return 550, "client already exists"
+	}
+	addClient(&client{id: id, name: strings.Join(args[1:], " ")})
+	return 200, "ok"
+}
+
+// mgmtClientKey sets the given or a random key for a client to
+// authenticate its sessions with.
+func (s *mgmtSession) mgmtClientKey(args []string, c *smtplike.Conn) (int, string) {
+	if len(args) < 1 || len(args) > 2 {
+		return 501, "invalid syntax"
+	}
+	if s.scoped {
+		return 550, scopedMsg
+	}
+	id, err := strconv.ParseUint(args[0], 0, 64)
+	if err != nil {
+		return 501, args[0] + ": " + err.Error()
 	}
-	return 210, s
+	var k nodeKey
+	if len(args) == 2 {
+		var ok bool
+		if k, ok = parseKey(args[1]); !ok || k.pub {
+			return 501, args[1] + ": invalid key"
+		}
+	} else if k, err = randomKey(); err != nil {
+		return 501, "rand: " + err.Error()
+	}
+	cl := getClient(id)
+	if cl == nil {
+		return 550, "client does not exist"
+	}
+	cl.key = k.key
+	addClient(cl)
+	return 210, fmt.Sprintf("key %x", []byte(k.key))
+}
+
+func (s *mgmtSession) mgmtRmClient(args []string, c *smtplike.Conn) (int, string) {
+	if len(args) != 1 {
+		return 501, "invalid syntax"
+	}
+	if s.scoped {
+		return 550, scopedMsg
+	}
+	id, err := strconv.ParseUint(args[0], 0, 64)
+	if err != nil {
+		return 501, args[0] + ": " + err.Error()
+	}
+	cl := getClient(id)
+	switch {
+	case cl == nil:
+		return 550, "client does not exist"
+	case cl.nodes != 0 || cl.jobs != 0:
+		return 550, fmt.Sprintf("client owns %d nodes and %d jobs",
+			cl.nodes, cl.jobs)
+	}
+	rmClient(cl)
+	return 200, "ok"
 }
 
 func mgmtSched(args []string, c *smtplike.Conn) (code int, msg string) {
@@ -167,29 +565,167 @@ func mgmtCommit(args []string, c *smtplike.Conn) (code int, msg string) {
 	return 210, "ok"
 }
 
+func (s *mgmtSession) mgmtInterval(args []string, c *smtplike.Conn) (code int, msg string) {
+	if len(args) > 2 {
+		return 501, "invalid syntax"
+	}
+	if s.scoped && len(args) != 0 {
+		return 550, scopedMsg
+	}
+	var iv [2]time.Duration
+	for i, v := range args {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return 501, v + ": " + err.Error()
+		}
+		if d < 0 {
+			return 501, v + ": negative interval"
+		}
+		iv[i] = d
+	}
+	switch len(args) {
+	case 2:
+		atomic.StoreInt64(&onceInterval, int64(iv[1]))
+		fallthrough
+	case 1:
+		atomic.StoreInt64(&nodeInterval, int64(iv[0]))
+	}
+	return 210, fmt.Sprintf("interval %v, one-shot %v",
+		time.Duration(atomic.LoadInt64(&nodeInterval)),
+		time.Duration(atomic.LoadInt64(&onceInterval)))
+}
+
+func (s *mgmtSession) mgmtLockout(args []string, c *smtplike.Conn) (int, string) {
+	if len(args) != 0 {
+		return 501, "invalid syntax"
+	}
+	if s.scoped {
+		return 550, scopedMsg
+	}
+	l := proto.Lockout
+	if l == nil {
+		return 210, "no lockout"
+	}
+	n, refused := l.Unauthenticated()
+	a := []string{fmt.Sprintf("authenticating %d (max %d), refused %d",
+		n, l.MaxUnauth, refused)}
+	for _, f := range append(l.Hosts(), l.Nodes()...) {
+		a = append(a, f.String())
+	}
+	return 210, strings.Join(a, "\n")
+}
+
+func (s *mgmtSession) mgmtUnlock(args []string, c *smtplike.Conn) (int, string) {
+	if len(args) != 1 {
+		return 501, "invalid syntax"
+	}
+	if s.scoped {
+		return 550, scopedMsg
+	}
+	if proto.Lockout == nil {
+		return 550, "no lockout"
+	}
+	var ok bool
+	if v := args[0]; strings.HasPrefix(v, "node:") {
+		id, err := strconv.ParseUint(v[5:], 0, 64)
+		if err != nil {
+			return 501, v + ": " + err.Error()
+		}
+		ok = proto.Lockout.ClearNode(id)
+	} else {
+		ok = proto.Lockout.ClearHost(v)
+	}
+	if !ok {
+		return 550, "no failures recorded"
+	}
+	return 200, "ok"
+}
+
+func (s *mgmtSession) mgmtRepl(args []string, c *smtplike.Conn) (int, string) {
+	if len(args) != 0 {
+		return 501, "invalid syntax"
+	}
+	if s.scoped {
+		return 550, scopedMsg
+	}
+	return 210, replStatus()
+}
+
+func (s *mgmtSession) mgmtPromote(args []string, c *smtplike.Conn) (int, string) {
+	if len(args) != 0 {
+		return 501, "invalid syntax"
+	}
+	if s.scoped {
+		return 550, scopedMsg
+	}
+	if err := replPromote(); err != nil {
+		return 550, err.Error()
+	}
+	return 200, "ok"
+}
+
 func mgmtHelp(args []string, c *smtplike.Conn) (code int, msg string) {
 	if len(args) != 0 {
 		return 501, "invalid syntax"
 	}
 	return 214, `commands:
+addclient <id> <name>
+    add client owning nodes and jobs
+auth <key>
+    authenticate with the management key, or with a client's key to
+    act for the client, seeing only its nodes, jobs and results
+client [<id>]
+    show client of session, or act for client <id> until the end of
+    the session, seeing only its nodes, jobs and results
+clientkey <id> [<key>]
+    set given or random key for client to authenticate with
 commit
     commit changes to database
 h|help
     help
-job <id> <period> <start> <capacity> <times> <check>...
-    add job
+interval [<interval> [<one-shot interval>]]
+    show or set reconnection intervals suggested to nodes, normally
+    and while they have one-shot jobs (0 for no suggestion)
+job [skip|queue|concurrent] <id> <period> <start> <capacity> <times> <check>...
+    add job; the node skips (default), queues or concurrently starts
+    a run that is due while the previous one is still running
 list
-    list nodes and jobs
-node <id> <capacity> <geoloc> [<key>]
-    add node
+    list clients, nodes and jobs
+lockout
+    show connections authenticating and failures to authenticate
+    by host and by node
+newkey <id> [<key>|ed25519:<public key>] [<overlap>]
+    add given or random key to node; older keys expire after overlap
+    (default 168h); the node gets a new shared key on next connection
+node <id> <capacity> <geoloc> [<key>|ed25519:<public key>]
+    add node with given or random shared key, or with public key
+once <id> <at> <capacity> <n>[@<geoloc>]|nodes:<id>[,<id>...] <check>...
+    add one-shot job running at Unix time <at> (0: on next connection)
+    on n nodes (at geoloc) or on the listed nodes
+promote
+    make a standby server active in a new epoch; the other server
+    steps down once it learns of the epoch
+pubkey
+    show server's public key for nodes using public keys
 quit
     quit
+repl
+    show replication role, epoch and link
+results <id>
+    list committed results of job
+rmclient <id>
+    remove client owning no nodes or jobs
 rmjob <id>
     remove job
 rmnode <id>
     remove node
+rollup <id> hourly|daily
+    list hourly or daily rollups of results of job per node: runs,
+    failures and minimum, average, maximum and 95th percentile run time
 sched
-    run scheduler and commit changes to database`
+    run scheduler and commit changes to database
+unlock <host>|node:<id>
+    forget failures to authenticate of host or node`
 }
 
 func mgmtQuit(args []string, c *smtplike.Conn) (code int, msg string) {
@@ -199,22 +735,41 @@ func mgmtQuit(args []string, c *smtplike.Conn) (code int, msg string) {
 	return smtplike.Goodbye, "bye"
 }
 
-var mgmt = smtplike.Proto{
-	{"", mgmtGreet},
-	{"h", mgmtHelp},
-	{"help", mgmtHelp},
-	{"job", mgmtAddJob},
-	{"list", mgmtList},
-	{"node", mgmtAddNode},
-	{"rmjob", mgmtRmJob},
-	{"rmnode", mgmtRmNode},
-	{"sched", mgmtSched},
-	{"commit", mgmtCommit},
-	{"quit", mgmtQuit},
+// proto returns the management protocol acting for s.
+func (s *mgmtSession) proto() smtplike.Proto {
+	return smtplike.Proto{
+		{"", mgmtGreet},
+		{"addclient", s.authed(active(s.mgmtAddClient))},
+		{"auth", s.mgmtAuth},
+		{"client", s.authed(s.mgmtClient)},
+		{"clientkey", s.authed(active(s.mgmtClientKey))},
+		{"h", mgmtHelp},
+		{"help", mgmtHelp},
+		{"interval", s.authed(s.mgmtInterval)},
+		{"job", s.authed(active(s.mgmtAddJob))},
+		{"list", s.authed(s.mgmtList)},
+		{"lockout", s.authed(s.mgmtLockout)},
+		{"newkey", s.authed(active(s.mgmtNewKey))},
+		{"node", s.authed(active(s.mgmtAddNode))},
+		{"once", s.authed(active(s.mgmtAddOnce))},
+		{"promote", s.authed(s.mgmtPromote)},
+		{"pubkey", mgmtPubKey},
+		{"repl", s.authed(s.mgmtRepl)},
+		{"results", s.authed(s.mgmtResults)},
+		{"rmclient", s.authed(active(s.mgmtRmClient))},
+		{"rmjob", s.authed(active(s.mgmtRmJob))},
+		{"rmnode", s.authed(active(s.mgmtRmNode))},
+		{"rollup", s.authed(s.mgmtRollup)},
+		{"sched", s.authed(active(mgmtSched))},
+		{"unlock", s.authed(s.mgmtUnlock)},
+		{"commit", s.authed(mgmtCommit)},
+		{"quit", mgmtQuit},
+	}
 }
 
 func mgmtHandle(c net.Conn) {
-	if err := mgmt.Run(c, nil); err != nil {
+	s := mgmtSession{peer: c.RemoteAddr().String()}
+	if err := s.proto().Run(c, nil); err != nil {
 		log.Err("management connection terminated: " + err.Error())
 		return
 	}
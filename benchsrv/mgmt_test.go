@@ -0,0 +1,83 @@
+// Benchnet
+//
+// Copyright 2012 Vadim Vygonets
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/unixdj/smtplike"
+	"io"
+	"testing"
+)
+
+func TestMgmtAuth(t *testing.T) {
+	log = &fileLogger{w: nopCloser{io.Discard}}
+	defer func(k []byte, l clist, n nlist, j jlist) {
+		mgmtKey, clients, nodes, jobs = k, l, n, j
+	}(mgmtKey, clients, nodes, jobs)
+	nodes, jobs = nil, nil
+	mgmtKey = bytes.Repeat([]byte{1}, 32)
+	clientKey := bytes.Repeat([]byte{2}, 32)
+	clients = clist{{id: 0, name: "default"}, {id: 2, name: "acme", key: clientKey}}
+	done := make(chan bool)
+	defer close(done)
+	go func() { // lookups only, as on a standby
+		for {
+			select {
+			case r := <-opChan:
+				doOp(r)
+			case <-done:
+				return
+			}
+		}
+	}()
+	ok := func([]string, *smtplike.Conn) (int, string) { return 200, "ok" }
+	auth := func(s *mgmtSession, key []byte, want int) {
+		t.Helper()
+		if code, msg := s.mgmtAuth([]string{fmt.Sprintf("%x", key)},
+			nil); code != want {
+			t.Errorf("auth %x: %d %s, want %d", key, code, msg, want)
+		}
+	}
+
+	var s mgmtSession
+	if code, _ := s.authed(ok)(nil, nil); code != 530 {
+		t.Errorf("unauthenticated: %d, want 530", code)
+	}
+	auth(&s, bytes.Repeat([]byte{3}, 32), 535)
+	auth(&s, clientKey, 200)
+	if !s.scoped || s.client != 2 || s.admin {
+		t.Errorf("client session %+v, want scoped to client 2", s)
+	}
+	if code, _ := s.authed(ok)(nil, nil); code != 200 {
+		t.Errorf("client session: %d, want 200", code)
+	}
+	auth(&s, mgmtKey, 503) // scoped sessions stay scoped
+	if _, l := s.mgmtList(nil, nil); l != "" {
+		t.Errorf("client list %q, want no nodes or jobs", l)
+	}
+
+	s = mgmtSession{}
+	auth(&s, mgmtKey, 200)
+	if s.scoped || !s.admin {
+		t.Errorf("admin session %+v, want unscoped", s)
+	}
+	if _, l := s.mgmtList(nil, nil); l != "Client 0\nname \"default\"\n\n"+
+		"Client 2\nname \"acme\"" {
+		t.Errorf("admin list %q", l)
+	}
+}
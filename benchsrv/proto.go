@@ -15,115 +15,140 @@
 // limitations under the License.
 
 /*
-	File proto.go implements the node-server protocol.
+	File proto.go connects the node-server protocol, implemented
+	in lib/conn, to the data loop.
 */
 
 package main
 
 import (
-	"encoding/binary"
-	"encoding/gob"
+	"errors"
 	"fmt"
 	"github.com/unixdj/benchnet/lib/conn"
-	"io"
 	"net"
+	"sync/atomic"
 	"time"
 )
 
+// nodeSource and resultSink connect the protocol to the data loop.
 type (
-	connData struct {
-		n *node
-		r []result
-	}
-	step func(*conn.Conn, *connData) (step, error)
+	nodeSource struct{}
+	resultSink struct{}
 )
 
-func sendGreet(c *conn.Conn, d *connData) (step, error) {
-	greets := make([]byte, len(conn.Greet))
-	copy(greets, conn.Greet)
-	return authClient, c.SendChallenge(greets)
-}
+// Reconnection intervals suggested to nodes in nanoseconds, 0 for
+// no suggestion.  Accessed atomically.
+var (
+	nodeInterval int64                // normally
+	onceInterval = int64(time.Minute) // while one-shot jobs are pending
+)
 
-func authClient(c *conn.Conn, d *connData) (step, error) {
-	var buf [16]byte
-	_, err := io.ReadFull(c, buf[:])
-	if err != nil {
-		return nil, err
+// suggestInterval returns the reconnection interval for a node with
+// job list l.
+func suggestInterval(l jobList) int64 {
+	for _, j := range l {
+		if j.Period == 0 {
+			if iv := atomic.LoadInt64(&onceInterval); iv != 0 {
+				return iv
+			}
+			break
+		}
 	}
-	//clientId := binary.BigEndian.Uint64(buf[:8])
-	id := binary.BigEndian.Uint64(buf[8:])
-	d.n = getNode(id)
-	if d.n == nil {
-		return nil, nodeNotFoundError(id)
-	}
-	c.SetKey(d.n.key)
-	c.WriteToHash(buf[:])
-	if err = c.CheckSig(); err != nil {
-		return nil, err
-	}
-	log.Info(fmt.Sprintf("client %s: authenticated node %d",
-		c.RemoteAddr(), id))
-	return recvLogs, c.ReceiveChallenge()
+	return atomic.LoadInt64(&nodeInterval)
 }
 
-func recvLogs(c *conn.Conn, d *connData) (step, error) {
-	var buf [8]byte
-	binary.BigEndian.PutUint64(buf[:], d.n.lastSeen)
-	_, err := c.Write(buf[:])
-	if err != nil {
-		return nil, err
+func (nodeSource) Node(id uint64) (*conn.Node, error) {
+	if isStandby() {
+		return nil, errStandby
 	}
-	if err = c.SendSig(); err != nil {
-		return nil, err
+	n := getNode(id)
+	if n == nil {
+		return nil, nodeNotFoundError(id)
 	}
-	d.n.lastSeen = uint64(time.Now().UnixNano())
-	if err = gob.NewDecoder(c).Decode(&d.r); err != nil {
-		return nil, err
+	cn := &conn.Node{
+		ClientId: n.client,
+		NodeId:   n.id,
+		LastSeen: n.lastSeen,
+		Caps:     n.caps,
+		Acked:    n.acked,
+		Jobs:     []conn.Job(n.jobs),
 	}
-	for i := range d.r {
-		d.r[i].nodeId = d.n.id
+	for _, k := range n.validKeys(clk.Now().UnixNano()) {
+		cn.Keys = append(cn.Keys, conn.Key{Key: k.key, Pub: k.pub})
 	}
-	return sendJobs, c.CheckSig()
+	return cn, nil
 }
 
-func sendJobs(c *conn.Conn, d *connData) (step, error) {
-	if err := gob.NewEncoder(c).Encode(d.n.jobs); err != nil {
-		return nil, err
-	}
-	return recvBye, c.SendSig()
+func (nodeSource) SetCaps(id uint64, caps []string) error {
+	setCaps(id, caps)
+	return nil
+}
+
+func (nodeSource) Watch(id uint64, w chan bool)   { watchNode(id, w) }
+func (nodeSource) Unwatch(id uint64, w chan bool) { unwatchNode(id, w) }
+
+func (nodeSource) Interval(l []conn.Job) time.Duration {
+	return time.Duration(suggestInterval(l))
 }
 
-func recvBye(c *conn.Conn, d *connData) (step, error) {
-	b, err := c.ReadByte()
-	if err != nil {
-		return nil, err
+// AddResults adds results r of node id, converting their times to
+// the server's clock.
+func (resultSink) AddResults(id uint64, r []conn.Result) {
+	if len(r) != 0 {
+		ra := make([]result, len(r))
+		for i, v := range r {
+			ra[i] = result{nodeId: id, Result: v}
+			ra[i].Start -= v.Skew
+		}
+		if skew := time.Duration(r[len(r)-1].Skew); skew > conn.MaxSkew ||
+			skew < -conn.MaxSkew {
+			log.Warning(fmt.Sprintf("node %d: clock is off by %v",
+				id, skew))
+		}
+		addResults(ra)
 	}
-	if b != 0 {
-		return nil, conn.ErrProto
+	requestCommit()
+}
+
+func (resultSink) Seen(id uint64, t uint64) {
+	nodeSeen(&node{id: id, lastSeen: t})
+}
+
+// proto talks to nodes, see initProto.
+var proto *conn.Server
+
+// Time for a node to authenticate
+var authTimeout = time.Minute
+
+// initProto sets up proto once the server key is loaded.
+func initProto() {
+	proto = conn.NewServer(nodeSource{}, resultSink{})
+	proto.Key, proto.Log, proto.Clock = serverKey, log, clk
+	proto.AuthTimeout = authTimeout
+}
+
+var errStandby = errors.New("standby server")
+
+// refuse closes nc if the server is a standby, so that the node tries
+// another server.
+func refuse(nc net.Conn) bool {
+	if !isStandby() {
+		return false
 	}
-	return nil, c.CheckSig()
+	nc.Close()
+	log.Info("client " + nc.RemoteAddr().String() + ": refused: " +
+		errStandby.Error())
+	return true
 }
 
 func handle(nc net.Conn) {
-	client := "client " + nc.RemoteAddr().String()
-	cc, err := conn.New(nc)
-	if err != nil {
-		nc.Close()
-		log.Notice(client + ": handle: " + err.Error())
-		return
-	}
-	defer cc.Close()
-	var d connData
-	f, err := sendGreet(cc, &d)
-	for f != nil && err == nil {
-		f, err = f(cc, &d)
+	if !refuse(nc) {
+		proto.Serve(nc)
 	}
-	if err != nil {
-		log.Notice(client + ": handle: " + err.Error())
-		return
+}
+
+func handleWS(nc net.Conn) {
+	if !refuse(nc) {
+		proto.ServeWS(nc)
 	}
-	log.Info(client + ": connection completed")
-	nodeSeen(d.n)
-	addResults(d.r)
-	requestCommit()
 }
@@ -0,0 +1,709 @@
+// Benchnet
+//
+// Copyright 2012 Vadim Vygonets
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+	File repl.go replicates the server to a standby.
+
+	Two servers point at each other with peer and replkey (see
+	benchsrv.conf).  Whichever has no replication link dials the
+	other.  The active server sends the standby a snapshot of all
+	state but results, then every commit: the diffs and results
+	committed.  The standby stores them and serves no nodes.
+
+	The "promote" management command makes a standby active in a new
+	epoch, stored in the database.  A server learning of a later
+	epoch from its peer steps down to standby, so once the servers
+	can talk, only the one promoted last schedules jobs and serves
+	nodes.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/unixdj/benchnet/lib/conn"
+	"io"
+	mrand "math/rand"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Configuration, see benchsrv.conf
+var (
+	replAddr    = "off" // address to listen on
+	peerAddr    string  // address of the other server
+	replKey     []byte  // shared key of the servers
+	initStandby bool    // role of a new database
+)
+
+const (
+	replGreet = "bench-repl-0\n"
+	replRetry = 10 * time.Second // between dialing the peer
+	replPing  = 30 * time.Second // link is dropped after 3 missed
+	replQueue = 256              // batches queued for the standby
+	replChunk = 1000             // results per batch when resyncing
+	replSlack = time.Hour        // see replResync
+)
+
+// Message types
+const (
+	replHelloMsg = 'h'
+	replBatchMsg = 'b'
+	replPingMsg  = 'p'
+)
+
+// replHello is sent by both servers after the challenges.
+type replHello struct {
+	Epoch  uint64
+	Active bool
+	Latest map[uint64]int64 // standby: start of latest result by node
+}
+
+// replBatch is a snapshot or a commit sent to the standby.
+type replBatch struct {
+	Reset   bool             // snapshot, replaces all state but results
+	Diffs   []replDiff       // as in dataDiff
+	Results []replResult     // as in result
+	Acks    map[uint64]int64 // acked of each node, see replLead
+}
+
+// replDiff, replJob, replNode, replKey, replClient and replResult
+// carry dataDiff and the types it refers to over the link.
+type (
+	replDiff struct {
+		Op                      int
+		JobId, NodeId, ClientId uint64
+		Job                     *replJob
+		Node                    *replNode
+		Client                  *replClient
+	}
+
+	replJob struct {
+		Job        conn.Job
+		Client     uint64
+		Capa, Want int
+		Region     uint64
+		Local      bool
+	}
+
+	replNode struct {
+		Id, Client, LastSeen uint64
+		Capa                 int
+		Loc                  uint64
+		Keys                 []replNodeKey
+		Caps                 []string
+	}
+
+	replNodeKey struct {
+		Key                 []byte
+		Pub                 bool
+		NotBefore, NotAfter int64
+	}
+
+	replClient struct {
+		Id   uint64
+		Name string
+		Key  []byte
+	}
+
+	replResult struct {
+		NodeId uint64
+		Result conn.Result
+	}
+)
+
+func toReplDiffs(l difflist) []replDiff {
+	a := make([]replDiff, len(l))
+	for i, v := range l {
+		d := replDiff{Op: v.op, JobId: v.jobId, NodeId: v.nodeId,
+			ClientId: v.clientId}
+		if j := v.j; j != nil {
+			d.Job = &replJob{j.jobDesc, j.client, j.capa, cap(j.nodes),
+				uint64(j.region), j.local}
+		}
+		if n := v.n; n != nil {
+			d.Node = &replNode{Id: n.id, Client: n.client,
+				LastSeen: n.lastSeen, Capa: n.capa,
+				Loc: uint64(n.loc), Caps: n.caps}
+			for _, k := range n.keys {
+				d.Node.Keys = append(d.Node.Keys, replNodeKey{k.key,
+					k.pub, k.notBefore, k.notAfter})
+			}
+		}
+		if c := v.c; c != nil {
+			d.Client = &replClient{c.id, c.name, c.key}
+		}
+		a[i] = d
+	}
+	return a
+}
+
+func fromReplDiffs(a []replDiff) difflist {
+	l := make(difflist, len(a))
+	for i, d := range a {
+		v := dataDiff{op: d.Op, jobId: d.JobId, nodeId: d.NodeId,
+			clientId: d.ClientId}
+		if j := d.Job; j != nil {
+			v.j = &job{jobDesc: j.Job, client: j.Client, capa: j.Capa,
+				nodes:  make([]uint64, 0, j.Want),
+				region: geoloc(j.Region), local: j.Local}
+		}
+		if n := d.Node; n != nil {
+			v.n = &node{id: n.Id, client: n.Client,
+				lastSeen: n.LastSeen, capa: n.Capa,
+				loc: geoloc(n.Loc), caps: n.Caps}
+			for _, k := range n.Keys {
+				v.n.keys = append(v.n.keys, nodeKey{k.Key, k.Pub,
+					k.NotBefore, k.NotAfter})
+			}
+		}
+		if c := d.Client; c != nil {
+			v.c = &client{id: c.Id, name: c.Name, key: c.Key}
+		}
+		l[i] = v
+	}
+	return l
+}
+
+func toReplResults(l reslist) []replResult {
+	a := make([]replResult, len(l))
+	for i, v := range l {
+		a[i] = replResult{v.nodeId, v.Result}
+	}
+	return a
+}
+
+func fromReplResults(a []replResult) reslist {
+	l := make(reslist, len(a))
+	for i, v := range a {
+		l[i] = result{v.NodeId, v.Result}
+	}
+	return l
+}
+
+// Replication state, owned by the data loop
+var (
+	replEpoch    uint64
+	replActive   bool
+	replFollower chan *replBatch // batches for the standby, if linked
+	replLeader   *conn.Conn      // link to the active server, if following
+)
+
+// standby is 1 while the server is a standby.  Accessed atomically.
+var standby int32
+
+func isStandby() bool {
+	return atomic.LoadInt32(&standby) != 0
+}
+
+// setActive sets and stores the role of the server.
+func setActive(active bool) {
+	replActive = active
+	var v int32
+	if !active {
+		v = 1
+	}
+	atomic.StoreInt32(&standby, v)
+	if err := saveRepl(replEpoch, active); err != nil {
+		log.Err("can't store replication state: " + err.Error())
+	}
+}
+
+// replInit loads the replication state.  Called from dataInit.
+func replInit() error {
+	var err error
+	if replEpoch, replActive, err = loadRepl(initStandby); err != nil {
+		return err
+	}
+	setActive(replActive)
+	role := "active"
+	if !replActive {
+		role = "standby"
+	}
+	log.Info(fmt.Sprintf("%s in replication epoch %d", role, replEpoch))
+	return nil
+}
+
+const (
+	replReqHello = iota
+	replReqLead
+	replReqUnlead
+	replReqApply
+	replReqPromote
+	replReqStatus
+)
+
+type replRequest struct {
+	op    int
+	hello replHello       // replReqHello
+	c     *conn.Conn      // replReqHello, replReqUnlead by the follower
+	f     chan *replBatch // replReqLead, replReqUnlead by the leader
+	b     *replBatch      // replReqApply
+	reply chan replReply
+}
+
+type replReply struct {
+	follow bool      // replReqHello: follow the peer, else lead
+	hello  replHello // replReqStatus: our state
+	status string    // replReqStatus
+	err    error
+}
+
+var replReqChan = make(chan replRequest) // synchronous
+
+var (
+	errSplitBrain = errors.New("both servers are active in the same epoch")
+	errNoActive   = errors.New("no active server")
+	errNotStandby = errors.New("not a standby")
+	errFellBehind = errors.New("standby fell behind")
+)
+
+// replSnapshot returns all state but results as a batch.  The acks
+// are sent after the results, see replLead.
+func replSnapshot() *replBatch {
+	var d difflist
+	b := &replBatch{Reset: true, Acks: make(map[uint64]int64)}
+	for _, c := range clients {
+		d = append(d, dataDiff{op: opAddClient, c: c})
+	}
+	for _, n := range nodes {
+		d = append(d, dataDiff{op: opAddNode, n: n})
+		if n.acked != 0 {
+			b.Acks[n.id] = n.acked
+		}
+	}
+	for _, j := range jobs {
+		d = append(d, dataDiff{op: opAddJob, j: j})
+		for _, id := range j.nodes {
+			d = append(d, dataDiff{op: opAddLink, jobId: j.Id,
+				nodeId: id})
+		}
+	}
+	b.Diffs = toReplDiffs(d)
+	return b
+}
+
+// replCommitted sends committed diffs and results to the standby.
+// A standby that doesn't keep up is dropped and gets a snapshot when
+// it's back.
+func replCommitted(d difflist, r reslist) {
+	if replFollower == nil {
+		return
+	}
+	b := &replBatch{Diffs: toReplDiffs(d), Results: toReplResults(r)}
+	select {
+	case replFollower <- b:
+	default:
+		log.Warning("replication: " + errFellBehind.Error())
+		close(replFollower)
+		replFollower = nil
+	}
+}
+
+// stepDown makes the server a standby after learning of a later
+// epoch.  Uncommitted changes are dropped, and a commit in flight
+// fails or isn't acknowledged (see dbCommit and commitDone), so that
+// nodes send their results to the active server.
+func stepDown() {
+	log.Err(fmt.Sprintf("replication: epoch %d has begun, stepping down",
+		replEpoch))
+	setActive(false)
+	diffs, results = nil, nil
+	if replFollower != nil {
+		close(replFollower)
+		replFollower = nil
+	}
+	for id := range watchers { // end streams, see nodeSource.Node
+		notify(id)
+	}
+}
+
+// promote makes a standby active in a new epoch and loads the state
+// replicated to it.
+func promote() error {
+	if replActive {
+		return errors.New("already active")
+	}
+	if replLeader != nil {
+		replLeader.Close()
+		replLeader = nil
+	}
+	diffs, results = nil, nil
+	if err := dbLoad(); err != nil {
+		return err
+	}
+	replEpoch++
+	setActive(true)
+	log.Notice(fmt.Sprintf("replication: promoted, epoch %d", replEpoch))
+	requestSchedule()
+	return nil
+}
+
+// doRepl serves requests of replication links and management.
+func doRepl(r replRequest) {
+	var rep replReply
+	switch r.op {
+	case replReqHello:
+		rep.follow, rep.err = replDecide(r.hello)
+		if rep.err == nil && rep.follow {
+			replLeader = r.c
+		}
+	case replReqLead:
+		if !replActive {
+			rep.err = errNoActive
+			break
+		}
+		if replFollower != nil {
+			close(replFollower)
+		}
+		replFollower = r.f
+		r.f <- replSnapshot()
+	case replReqUnlead:
+		if r.f != nil && replFollower == r.f {
+			close(replFollower)
+			replFollower = nil
+		}
+		if r.c != nil && replLeader == r.c {
+			replLeader = nil
+		}
+	case replReqApply:
+		if replActive {
+			rep.err = errNotStandby
+			break
+		}
+		rep.err = dbReplicate(r.b.Reset, fromReplDiffs(r.b.Diffs),
+			fromReplResults(r.b.Results), r.b.Acks)
+	case replReqPromote:
+		rep.err = promote()
+	case replReqStatus:
+		role, link := "active", "no link"
+		if !replActive {
+			role = "standby"
+		}
+		switch {
+		case replFollower != nil:
+			link = fmt.Sprintf("standby linked, %d batches queued",
+				len(replFollower))
+		case replLeader != nil:
+			link = "following " + replLeader.RemoteAddr().String()
+		}
+		rep.hello = replHello{Epoch: replEpoch, Active: replActive}
+		rep.status = fmt.Sprintf("%s, epoch %d, %s", role, replEpoch, link)
+	}
+	r.reply <- rep
+}
+
+// replDecide compares the hello of the peer with our state.  If the
+// peer has seen a later epoch, we step down.  Then the active server
+// leads and the standby follows.
+func replDecide(p replHello) (follow bool, err error) {
+	if p.Epoch > replEpoch || p.Epoch == replEpoch && p.Active &&
+		!replActive {
+		replEpoch = p.Epoch
+		if replActive {
+			stepDown()
+		} else {
+			setActive(false) // store epoch
+		}
+	}
+	switch {
+	case replActive && p.Active && p.Epoch == replEpoch:
+		return false, errSplitBrain
+	case replActive:
+		return false, nil // peer is standby or steps down
+	case p.Active && p.Epoch == replEpoch:
+		return true, nil
+	}
+	return false, errNoActive
+}
+
+// replCall sends a request to the data loop and waits for the reply.
+func replCall(r replRequest) replReply {
+	r.reply = make(chan replReply)
+	replReqChan <- r
+	return <-r.reply
+}
+
+// replStatus describes the replication state.
+func replStatus() string {
+	return replCall(replRequest{op: replReqStatus}).status
+}
+
+// replPromote makes a standby active.
+func replPromote() error {
+	return replCall(replRequest{op: replReqPromote}).err
+}
+
+// linked is 1 while a replication link is up.  Accessed atomically.
+var linked int32
+
+// replSend sends a message of type t with payload v, if not nil.
+func replSend(c *conn.Conn, t byte, v interface{}) error {
+	c.SetWriteDeadline(time.Now().Add(replPing))
+	if _, err := c.Write([]byte{t}); err != nil {
+		return err
+	}
+	if v != nil {
+		if err := c.Encode(v); err != nil {
+			return err
+		}
+	}
+	return c.SendSig()
+}
+
+// replRecv receives a message, decoding the payload of hello and
+// batch messages into v.
+func replRecv(c *conn.Conn, v interface{}) (byte, error) {
+	c.SetReadDeadline(time.Now().Add(3 * replPing))
+	var t [1]byte
+	if _, err := io.ReadFull(c, t[:]); err != nil {
+		return 0, err
+	}
+	switch t[0] {
+	case replHelloMsg, replBatchMsg:
+		if err := c.Decode(v); err != nil {
+			return 0, err
+		}
+	case replPingMsg:
+	default:
+		return 0, conn.ErrProto
+	}
+	return t[0], c.CheckSig()
+}
+
+// replLink runs a replication link on nc.
+func replLink(nc net.Conn) {
+	peer := "replication link " + nc.RemoteAddr().String()
+	if !atomic.CompareAndSwapInt32(&linked, 0, 1) {
+		nc.Close()
+		log.Notice(peer + ": already linked")
+		return
+	}
+	defer atomic.StoreInt32(&linked, 0)
+	c, err := conn.New(nc)
+	if err != nil {
+		nc.Close()
+		log.Notice(peer + ": " + err.Error())
+		return
+	}
+	defer c.Close()
+	p, follow, err := replHandshake(c)
+	switch {
+	case err != nil:
+	case follow:
+		log.Info(peer + ": following")
+		err = replFollow(c)
+	default:
+		log.Info(peer + ": leading")
+		err = replLead(c, p.Latest)
+	}
+	log.Notice(peer + ": " + err.Error())
+}
+
+// replHandshake exchanges challenges and hellos and decides whether
+// to follow the peer or lead.  It returns the peer's hello.
+func replHandshake(c *conn.Conn) (p replHello, follow bool, err error) {
+	var latest map[uint64]int64
+	if isStandby() {
+		if latest, err = loadLatest(); err != nil {
+			return
+		}
+	}
+	c.SetDeadline(time.Now().Add(replPing))
+	if err = c.SendChallenge([]byte(replGreet)); err != nil {
+		return
+	}
+	buf := make([]byte, len(replGreet))
+	if _, err = io.ReadFull(c, buf); err != nil {
+		return
+	}
+	if string(buf) != replGreet {
+		err = conn.ErrProto
+		return
+	}
+	if err = c.ReceiveChallenge(); err != nil {
+		return
+	}
+	c.SetKey(replKey)
+	c.Stream()
+	c.SetCompression(true)
+	h := replCall(replRequest{op: replReqStatus}).hello
+	h.Latest = latest
+	if err = replSend(c, replHelloMsg, &h); err != nil {
+		return
+	}
+	if _, err = replRecv(c, &p); err != nil {
+		return
+	}
+	rep := replCall(replRequest{op: replReqHello, hello: p, c: c})
+	return p, rep.follow, rep.err
+}
+
+// replLead sends a snapshot, the results the standby may be missing,
+// the acks of the snapshot, now that the standby has the results they
+// acknowledge, and then commits to the standby on c.
+func replLead(c *conn.Conn, latest map[uint64]int64) error {
+	f := make(chan *replBatch, replQueue)
+	if err := replCall(replRequest{op: replReqLead, f: f}).err; err != nil {
+		return err
+	}
+	defer replCall(replRequest{op: replReqUnlead, f: f})
+	errc := make(chan error, 1)
+	go func() { // the standby only pings
+		for {
+			if _, err := replRecv(c, nil); err != nil {
+				errc <- err
+				return
+			}
+		}
+	}()
+	snap, ok := <-f // queued first
+	if !ok {
+		return errors.New("dropped")
+	}
+	acks := snap.Acks
+	snap.Acks = nil
+	if err := replSend(c, replBatchMsg, snap); err != nil {
+		return err
+	}
+	if err := replResync(c, latest); err != nil {
+		return err
+	}
+	if err := replSend(c, replBatchMsg, &replBatch{Acks: acks}); err != nil {
+		return err
+	}
+	t := clk.NewTicker(replPing)
+	defer t.Stop()
+	for {
+		var err error
+		select {
+		case b, ok := <-f:
+			if !ok {
+				return errors.New("dropped")
+			}
+			err = replSend(c, replBatchMsg, b)
+		case <-t.C():
+			err = replSend(c, replPingMsg, nil)
+		case err = <-errc:
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// replResync sends the standby results of each node started since
+// replSlack before the latest it has, or all if it has none, to cover
+// runs finishing out of order.  Results it has are ignored, see
+// dbInsertResult.  Commits queue meanwhile.
+func replResync(c *conn.Conn, latest map[uint64]int64) error {
+	ids, err := loadResultNodes()
+	if err != nil {
+		return err
+	}
+	sent := 0
+	for _, id := range ids {
+		var from int64
+		if t, ok := latest[id]; ok {
+			from = t - int64(replSlack)
+		}
+		for {
+			l, err := loadNodeResults(id, from, replChunk)
+			if err != nil {
+				return err
+			}
+			if len(l) != 0 {
+				err = replSend(c, replBatchMsg,
+					&replBatch{Results: toReplResults(l)})
+				if err != nil {
+					return err
+				}
+				sent += len(l)
+			}
+			if len(l) < replChunk {
+				break
+			}
+			// the next chunk starts with the last start, sent
+			// again, unless the whole chunk started at once
+			next := l[len(l)-1].Start
+			if next == from {
+				next++
+			}
+			from = next
+		}
+	}
+	if sent != 0 {
+		log.Info(fmt.Sprintf("replication: sent %d stored results", sent))
+	}
+	return nil
+}
+
+// replFollow stores batches received from the active server on c.
+func replFollow(c *conn.Conn) error {
+	defer replCall(replRequest{op: replReqUnlead, c: c})
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		t := clk.NewTicker(replPing)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C():
+				if replSend(c, replPingMsg, nil) != nil {
+					return // reading fails too
+				}
+			}
+		}
+	}()
+	for {
+		var b replBatch
+		t, err := replRecv(c, &b)
+		if err != nil {
+			return err
+		}
+		if t != replBatchMsg {
+			continue
+		}
+		if err = replCall(replRequest{op: replReqApply, b: &b}).err; err != nil {
+			return err
+		}
+	}
+}
+
+// replHandle runs a replication link accepted from the peer.
+func replHandle(nc net.Conn) {
+	replLink(nc)
+}
+
+// replDial keeps dialing the peer while there's no replication link.
+func replDial() {
+	for {
+		if atomic.LoadInt32(&linked) == 0 {
+			nc, err := net.DialTimeout("tcp", peerAddr, replPing)
+			if err != nil {
+				log.Debug("replication: " + err.Error())
+			} else {
+				replLink(nc)
+			}
+		}
+		// spread out, in case both servers dial at once
+		<-clk.After(replRetry + time.Duration(mrand.Int63n(int64(replRetry))))
+	}
+}
@@ -0,0 +1,319 @@
+// Benchnet
+//
+// Copyright 2012 Vadim Vygonets
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+	File rollup.go keeps hourly and daily rollups of results per job
+	and node, updated as results are committed, and expires old raw
+	results and hourly rollups.
+*/
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/unixdj/benchnet/lib/stdb"
+	"math"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/*
+table rollups (primary key job, period, start, node):
+
+	job	job id
+	period	3600 for hourly, 86400 for daily rollups
+	start	start of the hour or day, nanoseconds since Unix epoch
+	node	node id
+	runs	number of results
+	fails	number of failed runs
+	rtmin	minimum run time, in nanoseconds
+	rtmax	maximum run time
+	rtsum	sum of run times
+	rtp95	95th percentile of run time, rounded up to the top of its
+		histogram bucket (by under 9%), or NULL if unknown (for
+		results rolled up before the histogram was kept)
+	hist	run time histogram: space-separated bucket:count pairs
+*/
+const (
+	dbSelectRollup = `SELECT runs, fails, rtmin, rtmax, rtsum, hist
+		FROM rollups WHERE job=? AND period=? AND start=? AND node=?`
+	dbUpsertRollup = `INSERT INTO rollups (job, period, start, node, runs,
+		fails, rtmin, rtmax, rtsum, rtp95, hist)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (job, period, start, node) DO UPDATE SET
+		runs=excluded.runs, fails=excluded.fails, rtmin=excluded.rtmin,
+		rtmax=excluded.rtmax, rtsum=excluded.rtsum,
+		rtp95=excluded.rtp95, hist=excluded.hist`
+	dbSelectJobRollups = `SELECT node, start, runs, fails, rtmin, rtmax,
+		rtsum, rtp95 FROM rollups WHERE job=? AND period=?
+		ORDER BY start, node`
+	dbExpireResults = "DELETE FROM results WHERE start < ?"
+	dbExpireRollups = "DELETE FROM rollups WHERE period=? AND start < ?"
+)
+
+// Rollup periods in seconds
+const (
+	hourly = 3600
+	daily  = 24 * hourly
+)
+
+// Days to keep raw results and hourly rollups, 0 for ever.  Daily
+// rollups are kept for ever.
+var retainResults, retainHourly uint64
+
+// dbBackfillRollups returns the statement rolling up stored results
+// for period, without the run time histogram.
+func dbBackfillRollups(period int64) string {
+	start := fmt.Sprintf("start - start %% %d", period*int64(time.Second))
+	return fmt.Sprintf(`INSERT INTO rollups (job, period, start, node,
+		runs, fails, rtmin, rtmax, rtsum, hist)
+		SELECT job, %d, %s, node, count(*), sum(flags & 1),
+		min(duration), max(duration), sum(duration), ''
+		FROM results GROUP BY job, %s, node`, period, start, start)
+}
+
+// Run time histogram buckets: bucket 0 holds run times under 1µs,
+// bucket b those from 2^((b-1)/rtPerOctave)µs to 2^(b/rtPerOctave)µs,
+// and the last one everything longer.
+const (
+	rtPerOctave = 8
+	rtBuckets   = 32*rtPerOctave + 1 // up to 2^32µs, over an hour
+)
+
+// rtBucket returns the histogram bucket for run time rt.
+func rtBucket(rt int64) int {
+	us := rt / int64(time.Microsecond)
+	if us < 1 {
+		return 0
+	}
+	b := int(math.Log2(float64(us))*rtPerOctave) + 1
+	if b >= rtBuckets {
+		b = rtBuckets - 1
+	}
+	return b
+}
+
+// rtBucketTop returns the upper bound of run times in bucket b.
+func rtBucketTop(b int) int64 {
+	return int64(math.Exp2(float64(b)/rtPerOctave) * float64(time.Microsecond))
+}
+
+// rollup summarizes results of a job on a node over a period.
+type rollup struct {
+	runs, fails         int64
+	rtMin, rtMax, rtSum int64
+	hist                map[int]int64 // run times by rtBucket
+}
+
+type rollupKey struct {
+	job, node     uint64
+	period, start int64
+}
+
+// rollups are rollups being updated by a commit.
+type rollups map[rollupKey]*rollup
+
+// add rolls up r into hourly and daily rollups.
+func (ru rollups) add(r *result) {
+	for _, p := range []int64{hourly, daily} {
+		ns := p * int64(time.Second)
+		k := rollupKey{r.JobId, r.nodeId, p, r.Start - r.Start%ns}
+		v := ru[k]
+		if v == nil {
+			v = &rollup{hist: make(map[int]int64)}
+			ru[k] = v
+		}
+		v.merge(&rollup{runs: 1, fails: int64(r.Flags & 1),
+			rtMin: r.RT, rtMax: r.RT, rtSum: r.RT,
+			hist: map[int]int64{rtBucket(r.RT): 1}})
+	}
+}
+
+// merge adds o to r.
+func (r *rollup) merge(o *rollup) {
+	if r.runs == 0 || o.rtMin < r.rtMin {
+		r.rtMin = o.rtMin
+	}
+	if r.runs == 0 || o.rtMax > r.rtMax {
+		r.rtMax = o.rtMax
+	}
+	r.runs += o.runs
+	r.fails += o.fails
+	r.rtSum += o.rtSum
+	for b, n := range o.hist {
+		r.hist[b] += n
+	}
+}
+
+// p95 returns the 95th percentile of run time, unless some runs are
+// missing from the histogram.
+func (r *rollup) p95() sql.NullInt64 {
+	var (
+		bs    []int
+		total int64
+	)
+	for b, n := range r.hist {
+		bs = append(bs, b)
+		total += n
+	}
+	if total != r.runs || total == 0 {
+		return sql.NullInt64{}
+	}
+	sort.Ints(bs)
+	rank, seen := (95*total+99)/100, int64(0)
+	for _, b := range bs {
+		if seen += r.hist[b]; seen >= rank {
+			v := rtBucketTop(b)
+			if v > r.rtMax {
+				v = r.rtMax
+			}
+			if v < r.rtMin {
+				v = r.rtMin
+			}
+			return sql.NullInt64{Int64: v, Valid: true}
+		}
+	}
+	return sql.NullInt64{} // not reached
+}
+
+// histString encodes the histogram for table rollups.
+func (r *rollup) histString() string {
+	bs := make([]int, 0, len(r.hist))
+	for b := range r.hist {
+		bs = append(bs, b)
+	}
+	sort.Ints(bs)
+	a := make([]string, len(bs))
+	for i, b := range bs {
+		a[i] = fmt.Sprintf("%d:%d", b, r.hist[b])
+	}
+	return strings.Join(a, " ")
+}
+
+// parseHist decodes a histogram from table rollups.
+func parseHist(s string) (map[int]int64, error) {
+	h := make(map[int]int64)
+	for _, f := range strings.Fields(s) {
+		var (
+			b int
+			n int64
+		)
+		if _, err := fmt.Sscanf(f, "%d:%d", &b, &n); err != nil ||
+			b < 0 || b >= rtBuckets {
+			return nil, fmt.Errorf("invalid histogram %q", s)
+		}
+		h[b] += n
+	}
+	return h, nil
+}
+
+// store merges ru into table rollups.
+func (ru rollups) store(tx *stdb.Tx) error {
+	for k, r := range ru {
+		var (
+			old  rollup
+			hist string
+		)
+		err := tx.QueryRow(dbSelectRollup, k.job, k.period, k.start,
+			k.node).Scan(&old.runs, &old.fails, &old.rtMin, &old.rtMax,
+			&old.rtSum, &hist)
+		switch {
+		case err == sql.ErrNoRows:
+		case err != nil:
+			return err
+		default:
+			if old.hist, err = parseHist(hist); err != nil {
+				return err
+			}
+			r.merge(&old)
+		}
+		if _, err = tx.Exec(dbUpsertRollup, k.job, k.period, k.start,
+			k.node, r.runs, r.fails, r.rtMin, r.rtMax, r.rtSum, r.p95(),
+			r.histString()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lastExpiry is the hour when expire last ran.  Accessed atomically.
+var lastExpiry int64
+
+// expire deletes raw results and hourly rollups past retention as of
+// now, at most once an hour: once tx is committed, expired records
+// the hour.
+func expire(tx *stdb.Tx, now int64) error {
+	if atomic.LoadInt64(&lastExpiry) == now/int64(time.Hour) {
+		return nil
+	}
+	day := int64(24 * time.Hour)
+	if retainResults != 0 {
+		r, err := tx.Exec(dbExpireResults, now-int64(retainResults)*day)
+		if err != nil {
+			return err
+		}
+		if n, err := r.RowsAffected(); err == nil && n != 0 {
+			log.Info(fmt.Sprintf("expired %d results", n))
+		}
+	}
+	if retainHourly != 0 {
+		_, err := tx.Exec(dbExpireRollups, hourly,
+			now-int64(retainHourly)*day)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expired records that expire ran at now in a committed transaction.
+func expired(now int64) {
+	atomic.StoreInt64(&lastExpiry, now/int64(time.Hour))
+}
+
+// loadJobRollups returns rollups of job id over period, one per line.
+func loadJobRollups(id uint64, period int64) ([]string, error) {
+	rows, err := dbc.Query(dbSelectJobRollups, id, period)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var a []string
+	for rows.Next() {
+		var (
+			node                uint64
+			start, runs, fails  int64
+			rtMin, rtMax, rtSum int64
+			p95                 sql.NullInt64
+			p95s                = "?"
+		)
+		if err := rows.Scan(&node, &start, &runs, &fails, &rtMin,
+			&rtMax, &rtSum, &p95); err != nil {
+			return nil, err
+		}
+		if p95.Valid {
+			p95s = time.Duration(p95.Int64).String()
+		}
+		a = append(a, fmt.Sprintf("node %d start %s runs %d fails %d rt min %v avg %v max %v p95 %s",
+			node, time.Unix(0, start).UTC().Format(time.RFC3339),
+			runs, fails, time.Duration(rtMin),
+			time.Duration(rtSum/runs), time.Duration(rtMax), p95s))
+	}
+	return a, nil
+}
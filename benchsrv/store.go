@@ -0,0 +1,272 @@
+// Benchnet
+//
+// Copyright 2012 Vadim Vygonets
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+	File store.go holds the storage backends.  Statements in db.go
+	are written for all of them, with "?" placeholders rewritten by
+	lib/stdb where needed; a backend supplies the schema, as
+	migrations run by dbOpen, and loads and commits the state,
+	by default with sqlStorage.
+*/
+
+package main
+
+import (
+	"errors"
+	_ "github.com/lib/pq"
+	"github.com/unixdj/benchnet/lib/stdb"
+	"strings"
+)
+
+// storage is a database backend.
+type storage interface {
+	// driver returns the database/sql driver name.
+	driver() string
+	// migrations returns the schema migrations, in order; existing
+	// ones must never change.
+	migrations() []stdb.Migration
+	// load loads the state, see dbLoad.
+	load() error
+	// commit stores diffs and results, see dbCommit.
+	commit(diffs difflist, results reslist) error
+	// replicate stores a batch from the active server, see
+	// dbReplicate.
+	replicate(reset bool, diffs difflist, results reslist,
+		acked map[uint64]int64) error
+}
+
+// sqlStorage loads and commits with the statements in db.go, which
+// both backends understand.
+type sqlStorage struct{}
+
+type (
+	sqliteStorage   struct{ sqlStorage }
+	postgresStorage struct{ sqlStorage }
+)
+
+// storages are the backends by name; store is the one in use.
+var (
+	storages = map[string]storage{
+		"sqlite3":  sqliteStorage{},
+		"postgres": postgresStorage{},
+	}
+	store storage = sqliteStorage{}
+)
+
+// storeValue is a flag.Value naming the backend.
+type storeValue struct{ s *storage }
+
+func (v storeValue) Set(s string) error {
+	st, ok := storages[s]
+	if !ok {
+		return errors.New(`must be "sqlite3" or "postgres"`)
+	}
+	*v.s = st
+	return nil
+}
+
+func (v storeValue) String() string {
+	if v.s == nil || *v.s == nil {
+		return ""
+	}
+	return (*v.s).driver()
+}
+
+func (sqliteStorage) driver() string { return "sqlite3" }
+
+func (sqliteStorage) migrations() []stdb.Migration {
+	return []stdb.Migration{
+		{
+			Desc: "create tables, upgrade unversioned database",
+			Stmts: []string{
+				dbCreateJobs,
+				dbCreateNodes,
+				dbCreateRunning,
+				dbCreateResults,
+				dbCreateKeys,
+				dbCreateAcks,
+				dbCreateClients,
+				dbDefaultClient,
+				dbCreateRepl,
+			},
+			Func: upgradeUnversioned,
+		},
+		{
+			Desc:  "add keys to results and running",
+			Stmts: sqliteKeys,
+		},
+		{
+			Desc: "add rollups",
+			Stmts: []string{
+				`CREATE TABLE rollups
+				(job integer, period integer, start integer,
+				node integer, runs integer, fails integer,
+				rtmin integer, rtmax integer, rtsum integer,
+				rtp95 integer, hist text,
+				PRIMARY KEY (job, period, start, node))`,
+				dbIndexRollups,
+				dbIndexResultsStart,
+				dbBackfillRollups(hourly),
+				dbBackfillRollups(daily),
+			},
+		},
+		{
+			Desc:  "index results by node for replication",
+			Stmts: []string{dbIndexResultsNode},
+		},
+		{
+			Desc:  "add management keys of clients",
+			Stmts: []string{"ALTER TABLE clients ADD COLUMN key blob[32]"},
+		},
+	}
+}
+
+// Indexes for loadJobResults, expire and replResync
+const (
+	dbIndexResults      = "CREATE INDEX results_job ON results (job, start)"
+	dbIndexResultsStart = "CREATE INDEX results_start ON results (start)"
+	dbIndexRollups      = "CREATE INDEX rollups_start ON rollups (period, start)"
+	dbIndexResultsNode  = "CREATE INDEX results_node ON results (node, start)"
+)
+
+// sqliteKeys rebuild tables results and running with primary keys,
+// dropping duplicate rows, and index results by job.
+var sqliteKeys = []string{
+	`CREATE TABLE results_new
+		(node integer, job integer, start integer, duration integer,
+		flags integer, err text, result text, delay integer,
+		skew integer, PRIMARY KEY (node, job, start))`,
+	`INSERT OR IGNORE INTO results_new SELECT node, job, start,
+		duration, flags, err, result, delay, skew
+		FROM results ORDER BY rowid`,
+	"DROP TABLE results",
+	"ALTER TABLE results_new RENAME TO results",
+	`CREATE TABLE running_new
+		(job integer, node integer, PRIMARY KEY (job, node))`,
+	"INSERT OR IGNORE INTO running_new SELECT job, node FROM running",
+	"DROP TABLE running",
+	"ALTER TABLE running_new RENAME TO running",
+	dbIndexResults,
+}
+
+// upgradeUnversioned brings tables created by versions before schema
+// migrations, which may be missing columns added since, up to date.
+func upgradeUnversioned(tx *stdb.Tx) error {
+	for _, v := range dbAddColumns {
+		_, err := tx.Exec(v)
+		if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			return err
+		}
+	}
+	// move keys from table nodes, where they were kept before
+	// nodes could have more than one key, to table keys
+	for _, v := range []string{dbMoveKeys, dbClearKeys} {
+		if _, err := tx.Exec(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PostgreSQL schema.  Times and ids are bigint, keys bytea and flags
+// boolean.  Ids and locations with the high bit set are stored as
+// negative numbers, see lib/stdb.  Table keys has a serial rowid,
+// standing in for SQLite's, to keep keys in the order they were added.
+const (
+	pgCreateNodes = `CREATE TABLE IF NOT EXISTS nodes
+		(id bigint primary key, last bigint, capa integer,
+		loc bigint, caps text, client bigint)`
+	pgCreateJobs = `CREATE TABLE IF NOT EXISTS jobs
+		(id bigint primary key, period integer, start integer,
+		capa integer, want integer, cmd text, overrun integer,
+		region bigint, client bigint)`
+	pgCreateRunning = `CREATE TABLE IF NOT EXISTS running
+		(job bigint, node bigint)`
+	pgCreateResults = `CREATE TABLE IF NOT EXISTS results
+		(node bigint, job bigint, start bigint, duration bigint,
+		flags integer, err text, result text, delay bigint,
+		skew bigint)`
+	pgCreateKeys = `CREATE TABLE IF NOT EXISTS keys
+		(rowid bigserial, node bigint, key bytea, pub boolean,
+		notbefore bigint, notafter bigint)`
+	pgCreateAcks = `CREATE TABLE IF NOT EXISTS acks
+		(node bigint primary key, seq bigint)`
+	pgCreateClients = `CREATE TABLE IF NOT EXISTS clients
+		(id bigint primary key, name text)`
+	pgCreateRepl = `CREATE TABLE IF NOT EXISTS repl
+		(id integer primary key, epoch bigint, active boolean)`
+)
+
+func (postgresStorage) driver() string { return "postgres" }
+
+func (postgresStorage) migrations() []stdb.Migration {
+	return []stdb.Migration{
+		{
+			Desc: "create tables",
+			Stmts: []string{
+				pgCreateJobs,
+				pgCreateNodes,
+				pgCreateRunning,
+				pgCreateResults,
+				pgCreateKeys,
+				pgCreateAcks,
+				pgCreateClients,
+				dbDefaultClient,
+				pgCreateRepl,
+			},
+		},
+		{
+			Desc:  "add keys to results and running",
+			Stmts: pgKeys,
+		},
+		{
+			Desc: "add rollups",
+			Stmts: []string{
+				`CREATE TABLE rollups
+				(job bigint, period integer, start bigint,
+				node bigint, runs bigint, fails bigint,
+				rtmin bigint, rtmax bigint, rtsum bigint,
+				rtp95 bigint, hist text,
+				PRIMARY KEY (job, period, start, node))`,
+				dbIndexRollups,
+				dbIndexResultsStart,
+				dbBackfillRollups(hourly),
+				dbBackfillRollups(daily),
+			},
+		},
+		{
+			Desc:  "index results by node for replication",
+			Stmts: []string{dbIndexResultsNode},
+		},
+		{
+			Desc:  "add management keys of clients",
+			Stmts: []string{"ALTER TABLE clients ADD COLUMN key bytea"},
+		},
+	}
+}
+
+// pgKeys add primary keys to tables results and running, dropping
+// duplicate rows, and index results by job.
+var pgKeys = []string{
+	`DELETE FROM results a USING results b
+		WHERE a.node=b.node AND a.job=b.job AND a.start=b.start
+		AND a.ctid > b.ctid`,
+	"ALTER TABLE results ADD PRIMARY KEY (node, job, start)",
+	`DELETE FROM running a USING running b
+		WHERE a.job=b.job AND a.node=b.node AND a.ctid > b.ctid`,
+	"ALTER TABLE running ADD PRIMARY KEY (job, node)",
+	dbIndexResults,
+}
@@ -0,0 +1,181 @@
+// Benchnet
+//
+// Copyright 2012 Vadim Vygonets
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"github.com/unixdj/benchnet/lib/conn"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Ids and location with the high bit set, which the databases store
+// as negative numbers
+const (
+	testNode   = 1<<63 | 5
+	testJob    = 1<<63 | 9
+	testRegion = 1<<63 | 7
+)
+
+// testStorage commits a client with a key, a node with keys, a job
+// running on it and a result, twice, loads them back and checks the
+// repl table.
+func testStorage(t *testing.T) {
+	log = &fileLogger{w: nopCloser{io.Discard}}
+	if err := dbOpen(); err != nil {
+		t.Fatal(err)
+	}
+	defer dbClose()
+	if err := saveRepl(3, true); err != nil {
+		t.Fatal(err)
+	}
+	keys := []nodeKey{
+		{key: bytes.Repeat([]byte{0, 0xff}, 16)},
+		{key: bytes.Repeat([]byte{0x80}, 32), pub: true,
+			notBefore: 1, notAfter: 1 << 62},
+	}
+	j := &job{
+		jobDesc: jobDesc{Id: testJob, Period: 60,
+			Check: []string{"dns", "example.com"}, Overrun: 1},
+		capa:   1,
+		nodes:  make([]uint64, 0, 1),
+		region: testRegion,
+		local:  true,
+	}
+	cl := &client{id: 2, name: "acme", key: keys[0].key}
+	d := difflist{
+		{op: opAddClient, c: cl},
+		{op: opAddNode, n: &node{id: testNode, capa: 10,
+			loc: testRegion, keys: keys,
+			caps: []string{conn.CapAck, conn.CapBatch}}},
+		{op: opAddJob, j: j},
+		{op: opAddLink, jobId: testJob, nodeId: testNode},
+	}
+	r := reslist{{testNode, conn.Result{JobId: testJob, Start: clk.Now().UnixNano(),
+		RT: 1000, S: []string{"a", "b"}, Seq: 4}}}
+	for i := 0; i < 2; i++ { // then all is stored already
+		if err := store.commit(d, r); err != nil {
+			t.Fatalf("commit %d: %v", i, err)
+		}
+	}
+	if err := dbLoad(); err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 1 || len(jobs) != 1 || len(clients) != 2 {
+		t.Fatalf("got %d nodes, %d jobs, %d clients, want 1, 1, 2",
+			len(nodes), len(jobs), len(clients))
+	}
+	if v := clients[1]; !reflect.DeepEqual(v, cl) || len(clients[0].key) != 0 {
+		t.Errorf("clients %+v, %+v, want default and %+v", clients[0],
+			v, cl)
+	}
+	n := nodes[0]
+	if !reflect.DeepEqual(n.keys, keys) {
+		t.Errorf("keys %+v, want %+v", n.keys, keys)
+	}
+	if n.id != testNode || n.loc != testRegion || len(n.caps) != 2 ||
+		n.acked != 4 || len(n.jobs) != 1 {
+		t.Errorf("node %d in %d, caps %v, acked %d, jobs %v", n.id,
+			n.loc, n.caps, n.acked, n.jobs)
+	}
+	if v := jobs[0]; v.Id != testJob || !v.local ||
+		v.region != testRegion || v.Overrun != 1 || len(v.nodes) != 1 ||
+		v.nodes[0] != testNode {
+		t.Errorf("job %+v, want local in region %d, overrun 1, "+
+			"running on node %d", v, uint64(testRegion), uint64(testNode))
+	}
+	if a, err := loadJobResults(testJob); err != nil || len(a) != 1 {
+		t.Errorf("results %q, %v, want 1", a, err)
+	}
+	if epoch, active, err := loadRepl(false); epoch != 3 || !active ||
+		err != nil {
+		t.Errorf("repl %d, %v, %v, want 3, true", epoch, active, err)
+	}
+	if err := saveRepl(4, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.commit(nil, r); err != errStandby {
+		t.Errorf("commit on standby: %v, want %v", err, errStandby)
+	}
+}
+
+func TestSQLite(t *testing.T) {
+	store = sqliteStorage{}
+	dbfile = filepath.Join(t.TempDir(), "benchsrv.db")
+	testStorage(t)
+}
+
+// TestPostgres needs a scratch database, which it empties first,
+// named by $BENCHSRV_PG_DSN, e.g., "dbname=benchtest sslmode=disable".
+func TestPostgres(t *testing.T) {
+	dsn := os.Getenv("BENCHSRV_PG_DSN")
+	if dsn == "" {
+		t.Skip("BENCHSRV_PG_DSN not set")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"schema_version", "jobs", "nodes",
+		"running", "results", "keys", "acks", "clients", "repl",
+		"rollups"} {
+		if _, err = db.Exec("DROP TABLE IF EXISTS " + v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+	store, dbfile = postgresStorage{}, dsn
+	testStorage(t)
+}
+
+// TestExpireAfterCommit checks that expiry rolled back stays due.
+func TestExpireAfterCommit(t *testing.T) {
+	log = &fileLogger{w: nopCloser{io.Discard}}
+	store = sqliteStorage{}
+	dbfile = filepath.Join(t.TempDir(), "benchsrv.db")
+	if err := dbOpen(); err != nil {
+		t.Fatal(err)
+	}
+	defer dbClose()
+	defer func(n uint64) { retainResults = n }(retainResults)
+	retainResults, lastExpiry = 1, 0
+	if err := saveRepl(1, true); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := dbc.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = dbApply(tx, nil, nil, clk.Now().UnixNano()); err != nil {
+		t.Fatal(err)
+	}
+	tx.Rollback()
+	if lastExpiry != 0 {
+		t.Errorf("expiry recorded for hour %d, rolled back", lastExpiry)
+	}
+	if err = store.commit(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if want := clk.Now().UnixNano() / int64(time.Hour); lastExpiry != want {
+		t.Errorf("expiry recorded for hour %d, want %d", lastExpiry, want)
+	}
+}
@@ -0,0 +1,182 @@
+// Benchnet
+//
+// Copyright 2012 Vadim Vygonets
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package clock abstracts the passage of time, so that code that
+// schedules things can be driven by a fake clock that advances
+// only when told to.
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock provides the subset of package time used by Benchnet.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker is like time.Ticker.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Real is the clock provided by package time.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+func (t realTicker) C() <-chan time.Time { return t.t.C }
+func (t realTicker) Stop()               { t.t.Stop() }
+
+// Fake is a clock that only moves when Advance or Set is called.
+// Timers and tickers fire from within Advance and Set, in order
+// of their deadlines.  Like their real counterparts, tickers drop
+// ticks if the receiver is slow.
+type Fake struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*waiter
+}
+
+// waiter is a pending timer or ticker.
+type waiter struct {
+	when   time.Time
+	period time.Duration // zero for timers
+	c      chan time.Time
+}
+
+type fakeTicker struct {
+	f *Fake
+	w *waiter
+}
+
+// NewFake returns a fake clock set to t.
+func NewFake(t time.Time) *Fake {
+	return &Fake{now: t}
+}
+
+// Now returns the current time of f.
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// After returns a channel that receives the time of f once it
+// has been advanced by d.
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w := &waiter{when: f.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		w.c <- f.now
+		return w.c
+	}
+	f.waiters = append(f.waiters, w)
+	return w.c
+}
+
+// NewTicker returns a ticker that ticks every d of the time of f.
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w := &waiter{when: f.now.Add(d), period: d, c: make(chan time.Time, 1)}
+	f.waiters = append(f.waiters, w)
+	return fakeTicker{f, w}
+}
+
+func (t fakeTicker) C() <-chan time.Time { return t.w.c }
+
+func (t fakeTicker) Stop() {
+	t.f.mu.Lock()
+	defer t.f.mu.Unlock()
+	t.f.remove(t.w)
+}
+
+// remove deletes w from the list of waiters.  f.mu must be held.
+func (f *Fake) remove(w *waiter) {
+	for i, v := range f.waiters {
+		if v == w {
+			f.waiters = append(f.waiters[:i], f.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// Advance moves the time of f forward by d, firing timers and
+// tickers on the way.
+func (f *Fake) Advance(d time.Duration) {
+	f.Set(f.Now().Add(d))
+}
+
+// Set moves the time of f forward to t, firing timers and tickers
+// on the way.  Time never goes back.
+func (f *Fake) Set(t time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for {
+		sort.Sort(byWhen(f.waiters))
+		if len(f.waiters) == 0 || f.waiters[0].when.After(t) {
+			break
+		}
+		w := f.waiters[0]
+		f.now = w.when
+		select {
+		case w.c <- w.when:
+		default: // drop the tick
+		}
+		if w.period == 0 {
+			f.waiters = f.waiters[1:]
+		} else {
+			w.when = w.when.Add(w.period)
+		}
+	}
+	if t.After(f.now) {
+		f.now = t
+	}
+}
+
+// Waiters returns the number of pending timers and tickers.
+// Tests may use it to wait until the code under test blocks.
+func (f *Fake) Waiters() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.waiters)
+}
+
+type byWhen []*waiter
+
+func (l byWhen) Len() int           { return len(l) }
+func (l byWhen) Less(i, j int) bool { return l[i].when.Before(l[j].when) }
+func (l byWhen) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
@@ -0,0 +1,595 @@
+// Benchnet
+//
+// Copyright 2012 Vadim Vygonets
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conn
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"fmt"
+	"github.com/unixdj/benchnet/lib/clock"
+	"io"
+	"time"
+)
+
+// ResultSource keeps results on the node until the server has them.
+// Results are numbered by Seq in the order they are stored.
+type ResultSource interface {
+	// ResultsSince returns results of checks started at or after t,
+	// nanoseconds since Unix epoch, and the highest Seq among them.
+	ResultsSince(t uint64) ([]*Result, int64, error)
+	// ResultsAfter returns up to max results stored after the one
+	// numbered seq, or all of them if max isn't positive.
+	ResultsAfter(seq int64, max int) ([]*Result, error)
+	// Ack deletes results up to seq, acknowledged by the server.
+	Ack(seq int64) error
+	// Expire deletes results of checks started before t, for servers
+	// that don't acknowledge results.
+	Expire(t uint64) error
+}
+
+// JobSink runs the jobs the server sends.
+type JobSink interface {
+	// SetJobs replaces the job list with l.
+	SetJobs(l []Job) error
+}
+
+// limits on sending results set by the server, 0 for none
+type limits struct {
+	batch int // results in a batch
+	bytes int // size of an encoded batch
+	total int // results in a connection
+}
+
+// Client is the node side of the protocol.  It talks to the server
+// on one connection at a time, see Talk.
+type Client struct {
+	ClientId, NodeId uint64
+	Key              []byte             // shared key, may be replaced by server
+	PrivKey          ed25519.PrivateKey // use instead of Key if set
+	ServerKey        ed25519.PublicKey  // required with PrivKey
+	Checks           []string           // checks supported, see CapCheck
+	Persistent       bool               // ask the server to stream
+	Results          ResultSource
+	Jobs             JobSink
+	Log              Logger
+	Clock            clock.Clock
+
+	// NewKey, if set, is called with the new shared key sent by the
+	// server.  The key replaces Key unless NewKey returns an error.
+	NewKey func(key []byte) error
+
+	noHello   bool          // server doesn't understand hello
+	noExtBye  bool          // server doesn't understand extended bye
+	agreed    *Hello        // version and caps agreed, nil for 0
+	authed    bool          // server accepted our auth
+	streaming bool          // server agreed to stream
+	suggested time.Duration // server's reconnection interval
+	streamed  int64         // last result sent, by seq
+	lim       limits        // server's limits
+	sent      time.Time     // when auth was sent
+	skew      int64         // our clock minus server's, ns
+	ready     chan bool     // new results stored
+}
+
+type clientStep func(*Conn) (clientStep, error)
+
+// NewClient returns a Client of node nodeId of client clientId,
+// sending results from r and passing jobs to j.
+func NewClient(clientId, nodeId uint64, r ResultSource, j JobSink) *Client {
+	return &Client{
+		ClientId: clientId,
+		NodeId:   nodeId,
+		Results:  r,
+		Jobs:     j,
+		Log:      nopLogger{},
+		Clock:    clock.Real,
+		ready:    make(chan bool, 1),
+	}
+}
+
+// Notify tells the stream there are new results to send.  It doesn't
+// block.
+func (c *Client) Notify() {
+	select {
+	case c.ready <- true:
+	default:
+	}
+}
+
+// Authenticated reports whether the server accepted the node on the
+// last connection.  If not, another server may be worth trying.
+func (c *Client) Authenticated() bool {
+	return c.authed
+}
+
+// Streaming reports whether the server agreed to stream on the last
+// connection.
+func (c *Client) Streaming() bool {
+	return c.streaming
+}
+
+// Suggested returns the reconnection interval suggested by the server
+// on the last connection, 0 for none.
+func (c *Client) Suggested() time.Duration {
+	return c.suggested
+}
+
+func (c *Client) recvGreet(s *Conn) (clientStep, error) {
+	buf := make([]byte, len(Greet))
+	_, err := io.ReadFull(s, buf)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Compare(buf[:len(Greet)], []byte(Greet)) != 0 {
+		return nil, ErrProto
+	}
+	if err = s.ReceiveChallenge(); err != nil || c.noHello {
+		return c.auth, err
+	}
+	return c.sendHello, nil
+}
+
+// hello returns our version and capabilities.
+func (c *Client) hello() *Hello {
+	h := &Hello{
+		Version: Version,
+		Caps: []string{CapAck, CapBatch, CapClock, CapGzip, CapOnce,
+			CapStream},
+	}
+	for _, v := range c.Checks {
+		h.Caps = append(h.Caps, CapCheck+v)
+	}
+	return h
+}
+
+func (c *Client) sendHello(s *Conn) (clientStep, error) {
+	us := c.hello()
+	if err := s.SendHello(us); err != nil {
+		return nil, err
+	}
+	them, err := s.ReadHello(nil)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			c.Log.Notice("server does not understand hello, " +
+				"falling back to version 0")
+			c.noHello = true
+		}
+		return nil, err
+	}
+	c.agreed = us.Agree(them)
+	s.SetCompression(c.agreed.Has(CapGzip))
+	c.Log.Debug(fmt.Sprintf("protocol version %d, capabilities %v",
+		c.agreed.Version, c.agreed.Caps))
+	return c.auth, nil
+}
+
+// can checks if the server supports capability v.  Version 0 servers
+// support streaming, but not any later features.
+func (c *Client) can(v string) bool {
+	if c.agreed == nil {
+		return v == CapStream
+	}
+	return c.agreed.Has(v)
+}
+
+func (c *Client) auth(s *Conn) (clientStep, error) {
+	s.Reset()
+	h := s.Hellos()
+	buf := make([]byte, len(h), len(h)+16+ed25519.SignatureSize+KeySize)
+	copy(buf, h)
+	buf = buf[:len(h)+16]
+	binary.BigEndian.PutUint64(buf[len(h):], c.ClientId)
+	binary.BigEndian.PutUint64(buf[len(h)+8:], c.NodeId)
+	buf = s.Sign(buf) // hellos are signed, but not sent again
+	c.sent = c.Clock.Now()
+	return c.sendLogs, s.SendChallenge(buf[len(h):])
+}
+
+func (c *Client) sendLogs(s *Conn) (clientStep, error) {
+	var buf [8]byte
+	if _, err := io.ReadFull(s, buf[:]); err != nil {
+		return nil, err
+	}
+	c.authed = true // the server replies once it verified auth
+	switch {
+	case batched(c.can):
+		return c.sendBatches(s, int64(binary.BigEndian.Uint64(buf[:])))
+	case c.can(CapAck):
+		return c.sendUnacked(s, int64(binary.BigEndian.Uint64(buf[:])))
+	}
+	then := binary.BigEndian.Uint64(buf[:])
+	now := uint64(c.Clock.Now().UnixNano())
+	if err := s.CheckSig(); err != nil {
+		return nil, err
+	}
+	var (
+		ra   []*Result
+		last int64
+		err  error
+	)
+	if then > now {
+		// the server's clock is ahead, so its last seen time
+		// says nothing about our results; send the ones we
+		// haven't sent, or all we have after restarting
+		c.Log.Notice(fmt.Sprintf("server's clock is ahead by %v",
+			time.Duration(then-now)))
+		if ra, err = c.Results.ResultsAfter(c.streamed, 0); err == nil &&
+			len(ra) != 0 {
+			last = ra[len(ra)-1].Seq
+		}
+		then = now
+	} else {
+		ra, last, err = c.Results.ResultsSince(then)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if last > c.streamed {
+		c.streamed = last
+	}
+	c.Log.Debug(fmt.Sprintf("sending %d results", len(ra)))
+	if err = s.Encode(ra); err != nil {
+		return nil, err
+	}
+	if then > now-uint64(time.Hour)*2 {
+		then = now - uint64(time.Hour)*2
+	}
+	c.Results.Expire(then)
+	return c.recvJobs, s.SendSig()
+}
+
+// readClock reads the server's time, if it sends it, and estimates
+// the skew of our clock, assuming that the server read its clock
+// halfway between us sending auth and receiving its time.
+func (c *Client) readClock(s *Conn) error {
+	c.skew = 0
+	if !c.can(CapClock) {
+		return nil
+	}
+	var buf [8]byte
+	if _, err := io.ReadFull(s, buf[:]); err != nil {
+		return err
+	}
+	now := c.Clock.Now()
+	mid := c.sent.Add(now.Sub(c.sent) / 2)
+	c.skew = mid.UnixNano() - int64(binary.BigEndian.Uint64(buf[:]))
+	if skew := time.Duration(c.skew); skew > MaxSkew || skew < -MaxSkew {
+		c.Log.Notice(fmt.Sprintf("clock is off by %v", skew))
+	} else {
+		c.Log.Debug(fmt.Sprintf("clock skew %v, round trip %v",
+			skew, now.Sub(c.sent)))
+	}
+	return nil
+}
+
+// stamp records the clock skew in results ra.
+func (c *Client) stamp(ra []*Result) {
+	for _, r := range ra {
+		r.Skew = c.skew
+	}
+}
+
+// sendUnacked deletes results up to seq acked and sends the rest.
+func (c *Client) sendUnacked(s *Conn, acked int64) (clientStep, error) {
+	if err := c.readClock(s); err != nil {
+		return nil, err
+	}
+	if err := s.CheckSig(); err != nil {
+		return nil, err
+	}
+	if err := c.Results.Ack(acked); err != nil {
+		return nil, err
+	}
+	ra, err := c.Results.ResultsAfter(acked, 0)
+	if err != nil {
+		return nil, err
+	}
+	c.streamed = acked
+	if len(ra) != 0 {
+		c.streamed = ra[len(ra)-1].Seq
+	}
+	c.Log.Debug(fmt.Sprintf("sending %d results after %d", len(ra), acked))
+	c.stamp(ra)
+	if err = s.Encode(ra); err != nil {
+		return nil, err
+	}
+	return c.recvJobs, s.SendSig()
+}
+
+// Time to send a batch of results
+const batchTimeout = 5 * time.Minute
+
+// encodeBatch encodes as many results from the start of ra as fit in
+// max bytes, on the wire and decompressed, if max is positive, and
+// returns the encoding and the number of results encoded.  A result
+// too large to fit on its own is sent as a failure.
+func encodeBatch(s *Conn, ra []*Result, max int) ([]byte, int, error) {
+	n := len(ra)
+	for {
+		b, raw, err := s.pack(ra[:n])
+		if err != nil {
+			return nil, 0, err
+		}
+		switch {
+		case max <= 0 || raw <= max: // len(b) <= raw
+			return b, n, nil
+		case n > 1:
+			n /= 2
+		case ra[0].S == nil && ra[0].Errs == "result too large":
+			return nil, 0, ErrTooBig // max is ridiculously low
+		default:
+			r := *ra[0]
+			r.Flags, r.Errs, r.S = ResFail, "result too large", nil
+			ra[0] = &r
+		}
+	}
+}
+
+// sendBatch sends prefix followed by as many results from the start
+// of ra as fit in a batch, and returns the number of results sent.
+func (c *Client) sendBatch(s *Conn, prefix []byte, ra []*Result) (int, error) {
+	c.stamp(ra)
+	buf, n, err := encodeBatch(s, ra, c.lim.bytes)
+	if err != nil {
+		return 0, err
+	}
+	s.SetWriteDeadline(time.Now().Add(batchTimeout))
+	if _, err = s.Write(append(prefix, buf...)); err != nil {
+		return 0, err
+	}
+	return n, s.SendSig()
+}
+
+// sendBatches deletes results up to seq acked and sends the rest in
+// batches within the server's limits.
+func (c *Client) sendBatches(s *Conn, acked int64) (clientStep, error) {
+	var buf [12]byte
+	if _, err := io.ReadFull(s, buf[:]); err != nil {
+		return nil, err
+	}
+	if err := c.readClock(s); err != nil {
+		return nil, err
+	}
+	if err := s.CheckSig(); err != nil {
+		return nil, err
+	}
+	c.lim = limits{
+		batch: int(binary.BigEndian.Uint32(buf[:])),
+		bytes: int(binary.BigEndian.Uint32(buf[4:])),
+		total: int(binary.BigEndian.Uint32(buf[8:])),
+	}
+	if err := c.Results.Ack(acked); err != nil {
+		return nil, err
+	}
+	c.streamed = acked
+	for total := 0; ; {
+		max := c.lim.batch
+		if c.lim.total != 0 && (max == 0 || c.lim.total-total < max) {
+			max = c.lim.total - total
+		}
+		ra := []*Result{}
+		if c.lim.total == 0 || max > 0 {
+			var err error
+			if ra, err = c.Results.ResultsAfter(c.streamed, max); err != nil {
+				return nil, err
+			}
+		}
+		n, err := c.sendBatch(s, nil, ra)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			break
+		}
+		c.streamed, total = ra[n-1].Seq, total+n
+		c.Log.Debug(fmt.Sprintf("sent %d results up to %d", n, c.streamed))
+	}
+	return c.recvJobs, s.SetReadDeadline(time.Now().Add(batchTimeout))
+}
+
+func (c *Client) recvJobs(s *Conn) (clientStep, error) {
+	var l []Job
+	if err := s.DecodeLimit(&l, maxJobs); err != nil {
+		return nil, err
+	}
+	c.Log.Debug(fmt.Sprintf("received %d jobs", len(l)))
+	if err := s.CheckSig(); err != nil {
+		return nil, err
+	}
+	if err := c.Jobs.SetJobs(l); err != nil {
+		c.Log.Err("can't update jobs: " + err.Error())
+	}
+	return c.sendBye, nil
+}
+
+func (c *Client) sendBye(s *Conn) (clientStep, error) {
+	if c.noExtBye {
+		if _, err := s.Write([]byte{0}); err != nil {
+			return nil, err
+		}
+		return nil, s.SendSig()
+	}
+	if _, err := s.Write([]byte{ByeExt}); err != nil {
+		return nil, err
+	}
+	m := byeMsg{Stream: c.Persistent && c.can(CapStream)}
+	if err := s.Encode(m); err != nil {
+		return nil, err
+	}
+	return c.recvByeReply, s.SendSig()
+}
+
+func (c *Client) recvByeReply(s *Conn) (clientStep, error) {
+	var r byeReply
+	if err := s.DecodeLimit(&r, maxMsg); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			c.Log.Notice("server does not understand extended bye, " +
+				"falling back to plain bye")
+			c.noExtBye = true
+		}
+		return nil, err
+	}
+	if err := s.CheckSig(); err != nil {
+		return nil, err
+	}
+	c.streaming, c.suggested = r.Stream, time.Duration(r.Interval)
+	if r.Key != nil && c.PrivKey == nil {
+		key, err := s.OpenKey(c.Key, r.Key)
+		if err == nil && c.NewKey != nil {
+			err = c.NewKey(key)
+		}
+		if err != nil {
+			c.Log.Err("can't store new key: " + err.Error())
+		} else {
+			c.Key = key
+			c.Log.Info("received new network key")
+		}
+	}
+	return nil, nil
+}
+
+// Talk talks to the server on s, which must be dialed with c.Key, up
+// to the goodbye.  If Streaming returns true afterwards, the caller
+// should call Stream.
+func (c *Client) Talk(s *Conn) error {
+	if c.PrivKey != nil {
+		if err := s.SetKeyPair(c.PrivKey, c.ServerKey); err != nil {
+			return err
+		}
+	}
+	c.authed, c.streaming, c.suggested = false, false, 0
+	c.agreed, c.lim = nil, limits{}
+	f, err := c.recvGreet(s)
+	for f != nil && err == nil {
+		f, err = f(s)
+	}
+	return err
+}
+
+// streamReader receives stream messages, passes job lists to jobc and
+// deletes acknowledged results until an error occurs, which is sent
+// to errc, or quit is closed.
+func (c *Client) streamReader(s *Conn, jobc chan<- []Job, errc chan<- error,
+	quit <-chan bool) {
+	for {
+		s.SetReadDeadline(time.Now().Add(3 * PingInterval))
+		t, err := s.ReadByte()
+		if err != nil {
+			errc <- err
+			return
+		}
+		var (
+			l     []Job
+			acked int64
+		)
+		switch t {
+		case MsgPing:
+		case MsgJobs:
+			err = s.DecodeLimit(&l, maxJobs)
+		case MsgAck:
+			err = s.DecodeLimit(&acked, maxMsg)
+		default:
+			err = ErrProto
+		}
+		if err == nil {
+			err = s.CheckSig()
+		}
+		if err != nil {
+			errc <- err
+			return
+		}
+		if t == MsgAck {
+			if err = c.Results.Ack(acked); err != nil {
+				c.Log.Err("can't delete results: " + err.Error())
+			}
+		}
+		if t == MsgJobs {
+			select {
+			case jobc <- l:
+			case <-quit:
+				return
+			}
+		}
+	}
+}
+
+// streamResults sends results stored since the last time.
+func (c *Client) streamResults(s *Conn) error {
+	for {
+		ra, err := c.Results.ResultsAfter(c.streamed, c.lim.batch)
+		if err != nil {
+			return err
+		}
+		if len(ra) == 0 {
+			break
+		}
+		n, err := c.sendBatch(s, []byte{MsgResults}, ra)
+		if err != nil {
+			return err
+		}
+		c.streamed = ra[n-1].Seq
+		c.Log.Debug(fmt.Sprintf("streamed %d results up to %d",
+			n, c.streamed))
+	}
+	if c.can(CapAck) {
+		return nil // deleted when acknowledged
+	}
+	return c.Results.Expire(uint64(c.Clock.Now().UnixNano()) -
+		uint64(time.Hour)*2)
+}
+
+// Stream keeps the connection open after Talk, passing job lists
+// pushed by the server to c.Jobs and sending results as soon as
+// Notify is called.  It returns ErrKilled when quit fires, or the
+// error that broke the stream.
+func (c *Client) Stream(s *Conn, quit <-chan bool) error {
+	s.Stream()
+	var (
+		jobc = make(chan []Job)
+		errc = make(chan error, 1)
+		done = make(chan bool)
+		ping = c.Clock.NewTicker(PingInterval)
+	)
+	defer func() {
+		ping.Stop()
+		close(done)
+	}()
+	go c.streamReader(s, jobc, errc, done)
+	c.Notify() // anything stored while talking
+	for {
+		select {
+		case <-quit:
+			return ErrKilled
+		case err := <-errc:
+			return err
+		case l := <-jobc:
+			c.Log.Debug(fmt.Sprintf("received %d jobs", len(l)))
+			if err := c.Jobs.SetJobs(l); err != nil {
+				c.Log.Err("can't update jobs: " + err.Error())
+			}
+		case <-c.ready:
+			if err := c.streamResults(s); err != nil {
+				return err
+			}
+		case <-ping.C():
+			if err := s.sendMsg(MsgPing, nil); err != nil {
+				return err
+			}
+		}
+	}
+}
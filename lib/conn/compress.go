@@ -0,0 +1,165 @@
+// Benchnet
+//
+// Copyright 2012 Vadim Vygonets
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conn
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/gob"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+)
+
+// With compression on, each gob payload is preceded by its length as
+// a 32-bit big-endian integer.  If the top bit of the length is set,
+// the payload is gzipped.  Payloads are signed as sent.
+const (
+	compressMin  = 256     // smaller payloads are sent as is
+	compressFlag = 1 << 31 // payload is gzipped
+	maxFrame     = 1 << 30 // sanity limit on payload length, inflated or not
+)
+
+// Stats counts payload bytes before compression (Raw) and on the
+// wire (Wire).  Only payloads received with compression on are
+// counted.
+type Stats struct {
+	Raw, Wire int64
+}
+
+// SetCompression turns compression of payloads sent with Encode and
+// received with Decode on or off.  Both sides must agree on it.
+func (c *Conn) SetCompression(on bool) {
+	c.compress = on
+}
+
+// Stats returns payload statistics of data received.
+func (c *Conn) Stats() Stats {
+	return Stats{atomic.LoadInt64(&c.in.Raw), atomic.LoadInt64(&c.in.Wire)}
+}
+
+// Ratio returns how many times s.Raw is larger than s.Wire.
+func (s Stats) Ratio() float64 {
+	if s.Wire == 0 {
+		return 1
+	}
+	return float64(s.Raw) / float64(s.Wire)
+}
+
+// Pack returns v gob-encoded as Encode would send it, so that its
+// size can be checked before sending it with Write.
+func (c *Conn) Pack(v interface{}) ([]byte, error) {
+	buf, _, err := c.pack(v)
+	return buf, err
+}
+
+// pack is Pack that also returns the size of the payload before
+// compression, including the length, which the reader's limit
+// applies to as well.
+func (c *Conn) pack(v interface{}) ([]byte, int, error) {
+	var b bytes.Buffer
+	if !c.compress {
+		err := gob.NewEncoder(&b).Encode(v)
+		return b.Bytes(), b.Len(), err
+	}
+	b.Write(make([]byte, 4))
+	if err := gob.NewEncoder(&b).Encode(v); err != nil {
+		return nil, 0, err
+	}
+	raw, flag := b.Len(), uint32(0)
+	if raw-4 >= maxFrame {
+		return nil, 0, ErrTooBig
+	}
+	if raw-4 >= compressMin {
+		var z bytes.Buffer
+		z.Write(make([]byte, 4))
+		w := gzip.NewWriter(&z)
+		w.Write(b.Bytes()[4:])
+		if err := w.Close(); err != nil {
+			return nil, 0, err
+		}
+		if z.Len() < b.Len() {
+			b, flag = z, compressFlag
+		}
+	}
+	buf := b.Bytes()
+	binary.BigEndian.PutUint32(buf, uint32(len(buf)-4)|flag)
+	return buf, raw, nil
+}
+
+// Encode gob-encodes v and writes it, compressed if compression is on.
+func (c *Conn) Encode(v interface{}) error {
+	buf, err := c.Pack(v)
+	if err != nil {
+		return err
+	}
+	_, err = c.Write(buf)
+	return err
+}
+
+// Decode reads a payload written by Encode and decodes it into v.
+// The read limit, if set, bounds the payload both on the wire and
+// decompressed.
+func (c *Conn) Decode(v interface{}) error {
+	if !c.compress {
+		return gob.NewDecoder(c).Decode(v)
+	}
+	limit, limited := c.limit, c.limited
+	var h [4]byte
+	if _, err := io.ReadFull(c, h[:]); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(h[:])
+	zipped := n&compressFlag != 0
+	n &^= compressFlag
+	if n >= maxFrame || (limited && int64(n) > c.limit) {
+		return ErrTooBig
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		return err
+	}
+	wire := int64(n) + 4
+	if zipped {
+		zr, err := gzip.NewReader(bytes.NewReader(buf))
+		if err != nil {
+			return err
+		}
+		max := int64(maxFrame) - 1
+		if limited && limit-4 < max {
+			max = limit - 4
+		}
+		buf, err = ioutil.ReadAll(io.LimitReader(zr, max+1))
+		if err != nil {
+			return err
+		}
+		if int64(len(buf)) > max {
+			return ErrTooBig
+		}
+	}
+	atomic.AddInt64(&c.in.Raw, int64(len(buf))+4)
+	atomic.AddInt64(&c.in.Wire, wire)
+	return gob.NewDecoder(bytes.NewReader(buf)).Decode(v)
+}
+
+// DecodeLimit is Decode with the read limit set to n, removed after.
+func (c *Conn) DecodeLimit(v interface{}, n int64) error {
+	c.SetReadLimit(n)
+	defer c.SetReadLimit(-1)
+	return c.Decode(v)
+}
@@ -21,15 +21,89 @@
 // Protocol:
 //
 //   S: <greet> <s-challenge>
-//   C: <id> hmac(key, s-challenge) <c-challenge>
+//   C: <hello>
+//   S: <hello>
+//   C: <id> hmac(key, hellos + id + s-challenge) <c-challenge>
+//   S: <last seen> hmac(key, last + c-challenge)
 //   C: <logs> hmac(key, logs + s-challenge)
 //   S: <new joblist> hmac(key, joblist + c-challenge)
-//   C: <zero byte> hmac(key, "\0" + c-challenge)
+//   C: <zero byte> hmac(key, "\0" + s-challenge)
 //
-// The same hash buffer is used for reading and writing.  Therefore the
-// basic loop should be:
+// The hello lines, see Hello, carry the protocol version and
+// capabilities of each side.  Version 0 nodes don't send hello, and
+// the server doesn't answer it.  A version 0 server takes the hello
+// for the node id and closes the connection, so the node falls back
+// to version 0.  The node signs both hello lines with its id.
+//
+// If both sides have the "ack" capability, <last seen> is replaced by
+// the highest sequence number of the node's results that the server
+// has stored.  The node deletes those and sends the ones after it.
+//
+// If both sides also have the "batch" capability, the server follows
+// the sequence number with its limits, and the node sends the logs in
+// batches, each signed on its own, ending with an empty one:
+//
+//   S: <acked> <batch size> <batch bytes> <total> hmac(key, ... + c-challenge)
+//   C: <logs> hmac(key, logs + s-challenge)
+//   ...
+//   C: <empty logs> hmac(key, logs + s-challenge)
+//
+// The limits are 32-bit big-endian integers: the number of results in
+// a batch, the size of an encoded batch, and the number of results in
+// one connection.  The node sends the rest on the next connection.
+// Stream messages with results obey the same limits.
+//
+// If both sides have the "ack" and "clock" capabilities, the server
+// ends the message with the sequence number by its time as a 64-bit
+// big-endian number of nanoseconds since Unix epoch.  The node
+// estimates how far its clock is off and sends the skew with each
+// result, so that the server can convert the times of the results to
+// its clock.  Without it, a server whose clock is ahead sends <last
+// seen> in the node's future; the node then sends the results it
+// hasn't sent before.
+//
+// If both sides have the "gzip" capability, gob payloads after the
+// hello lines are framed and may be compressed, see Encode.
+//
+// Instead of the zero byte, a node that wants more than a goodbye
+// may send the extended bye, which older servers don't understand:
+//
+//   C: <one byte> <bye> hmac(key, "\1" + bye + s-challenge)
+//   S: <bye reply> hmac(key, reply + c-challenge)
+//
+// If both sides agree to stream, the connection stays open and each
+// side sends messages whenever it wants:
+//
+//   <type> <payload> hmac(key, type + payload + challenge + seq)
+//
+// where seq is the number of the message in its direction, starting
+// from zero, as a 64-bit big-endian integer.
+//
+// The server may know several keys of a node, valid at overlapping
+// times, and try each of them.  In the reply to the extended bye it
+// may then send a new shared key, XORed with hmac(old key,
+// "bench-gossip key\0" + s-challenge + c-challenge).
+//
+// Instead of a shared HMAC key, the node and the server may each have
+// an Ed25519 key pair and know the other's public key.  Then hmac(key,
+// data) above stands for a signature of sha256(data) made with the
+// sender's private key.
+//
+// The protocol runs over plain TCP on Port or over TLS on TLSPort.
+// With TLS the node normally pins the server certificate, and the
+// exchange above still authenticates the node.  Where only HTTPS gets
+// through, the same exchange is carried in binary WebSocket messages
+// over TLS on WSPort (see DialWS and Server.ServeWS).
+//
+// Client and Server implement both sides of the protocol over a Conn.
+// The node provides a ResultSource and a JobSink, the server a
+// JobSource and a ResultSink.
+//
+// Data read and data written are hashed separately, so one goroutine
+// may read while another one writes.  Each of them should loop:
 //   Read(buf)
 //   CheckSig()
+// or:
 //   Write(buf)
 //   SendSig()
 package conn
@@ -37,9 +111,13 @@ package conn
 import (
 	"bufio"
 	"bytes"
+	"crypto/ed25519"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
 	"errors"
 	"hash"
 	"io"
@@ -49,21 +127,30 @@ import (
 
 const (
 	Port    = ":25198" // 0x626e == 'b'<<8 | 'n' ("bn" for benchnet)
+	TLSPort = ":25199" // same over TLS
 	KeySize = sha256.Size
 	Greet   = "bench-gossip-0\n"
 )
 
-// Node data.  The client knows it, the server has mapping from Id to key.
-type Node struct {
-	ClientId, NodeId uint64
-	LastSeen         uint64
-	Key              []byte
-}
+// Extended bye and stream messages
+const (
+	ByeExt     = 1 // byte starting the extended bye
+	MsgPing    = 0 // stream message with no payload, keeps connection alive
+	MsgJobs    = 1 // stream message with job list from server
+	MsgResults = 2 // stream message with results from node
+	MsgAck     = 3 // stream message with acknowledged sequence number
+
+	// Interval between pings on an idle stream.  A stream is dead
+	// after three intervals of silence.
+	PingInterval = 5 * time.Minute
+)
 
 var (
 	ErrProto   = errors.New("protocol error")
 	ErrSig     = errors.New("signature mismatch")
 	ErrKeySize = errors.New("invalid key size")
+	ErrCert    = errors.New("server certificate does not match")
+	ErrTooBig  = errors.New("message too big")
 )
 
 // Conn represents a connection on either side.
@@ -71,15 +158,25 @@ type Conn struct {
 	c        net.Conn
 	r        *bufio.Reader
 	w        *bufio.Writer
-	h        hash.Hash
-	chalThem []byte // challenge we send them
-	chalUs   []byte // they challenge us
+	hr, hw   hash.Hash          // hashes of data read and written
+	priv     ed25519.PrivateKey // our key in public key mode
+	peer     ed25519.PublicKey  // their key in public key mode
+	chalThem []byte             // challenge we send them
+	chalUs   []byte             // they challenge us
+	stream   bool               // sign sequence numbers
+	hellos   []byte             // hello lines exchanged
+	limit    int64              // bytes left to read, if limited
+	limited  bool               // limit is set
+	compress bool               // compress payloads, see Encode
+	in       Stats              // statistics of payloads received
+	nr, nw   uint64             // sequence numbers of messages read and written
 }
 
-// Reset resets the hash function.
+// Reset resets the hash functions.
 func (c *Conn) Reset() {
-	if c.h != nil {
-		c.h.Reset()
+	if c.hr != nil {
+		c.hr.Reset()
+		c.hw.Reset()
 	}
 }
 
@@ -88,44 +185,76 @@ func (c *Conn) Flush() error {
 	return c.w.Flush()
 }
 
-// WriteToHash adds more data to the hash.
+// WriteToHash adds more data to the hash of data read, as if it was
+// received from the network.
 func (c *Conn) WriteToHash(buf []byte) {
-	if c.h != nil {
-		c.h.Write(buf)
+	if c.hr != nil {
+		c.hr.Write(buf)
 	}
 }
 
-// Write writes data to the hash and to the network connection.
+// Write writes data to the hash of data written and to the network
+// connection.
 func (c *Conn) Write(buf []byte) (int, error) {
-	c.WriteToHash(buf)
+	if c.hw != nil {
+		c.hw.Write(buf)
+	}
 	return c.w.Write(buf)
 }
 
-// Sign adds data in buf to the hash and then appends the current hash
-// to buf.  Then it resets the hash.
+// seq returns the next sequence number from *n as a byte slice,
+// or nil if not streaming.
+func (c *Conn) seq(n *uint64) []byte {
+	if !c.stream {
+		return nil
+	}
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], *n)
+	*n++
+	return buf[:]
+}
+
+// Sign adds data in buf to the hash of data written and then appends
+// the current hash to buf.  Then it resets the hash.
 func (c *Conn) Sign(buf []byte) []byte {
-	c.WriteToHash(buf)
-	c.WriteToHash(c.chalUs)
-	buf = c.h.Sum(buf)
-	c.h.Reset()
+	c.hw.Write(buf)
+	c.hw.Write(c.chalUs)
+	c.hw.Write(c.seq(&c.nw))
+	if c.priv != nil {
+		buf = append(buf, ed25519.Sign(c.priv, c.hw.Sum(nil))...)
+	} else {
+		buf = c.hw.Sum(buf)
+	}
+	c.hw.Reset()
 	return buf
 }
 
-// SendSig sends the current hash to the network and resets the hash.
+// SendSig sends the current hash of data written to the network and
+// resets the hash.
 func (c *Conn) SendSig() error {
-	if c.h == nil {
+	if c.hw == nil {
 		return ErrProto
 	}
-	buf := c.Sign(make([]byte, 0, KeySize))
+	buf := c.Sign(make([]byte, 0, ed25519.SignatureSize))
 	if _, err := c.w.Write(buf); err != nil {
 		return err
 	}
 	return c.w.Flush()
 }
 
-// Read receives data from the network and appends it to the hash.
+// Read receives data from the network and appends it to the hash
+// of data read.
 func (c *Conn) Read(buf []byte) (int, error) {
+	if c.limited {
+		if c.limit <= 0 {
+			return 0, ErrTooBig
+		}
+		if int64(len(buf)) > c.limit {
+			buf = buf[:c.limit]
+		}
+	}
 	n, err := c.r.Read(buf)
+	c.limit -= int64(n)
 	if err != nil {
 		return n, err
 	}
@@ -133,35 +262,111 @@ func (c *Conn) Read(buf []byte) (int, error) {
 	return n, nil
 }
 
+// SetReadLimit limits the data that Read and ReadByte may receive
+// to n bytes, after which they return ErrTooBig.  Signatures are
+// not counted.  A negative n removes the limit.
+func (c *Conn) SetReadLimit(n int64) {
+	c.limit, c.limited = n, n >= 0
+}
+
 // ReadByte is here to implement io.ByteReader, because if we
 // don't, the gob decoder will wrap us in a bufio.Reader and
 // overread the data from the connection.  However, gob never
 // actually calls ReadByte.
 func (c *Conn) ReadByte() (byte, error) {
+	if c.limited && c.limit <= 0 {
+		return 0, ErrTooBig
+	}
 	b, err := c.r.ReadByte()
 	if err != nil {
 		return 0, err
 	}
+	c.limit--
 	c.WriteToHash([]byte{b})
 	return b, nil
 }
 
-// CheckSig receives signature from network, checks it
-// and resets the hash buffer.  ErrSig is returned on mismatch.
+// CheckSig receives signature from network, checks it against the
+// hash of data read and resets the hash.  ErrSig is returned on
+// mismatch.
 func (c *Conn) CheckSig() error {
-	var rsig, csig [KeySize]byte // received/computed sig
-	if _, err := io.ReadFull(c.r, rsig[:]); err != nil {
+	sig, err := c.ReadSig()
+	if err != nil {
 		return err
 	}
-	c.WriteToHash(c.chalThem)
-	c.h.Sum(csig[:0])
-	c.h.Reset()
-	if !bytes.Equal(rsig[:], csig[:]) {
+	return c.VerifySig(sig)
+}
+
+// ReadSig receives signature from network without checking it.
+// The size of the signature depends on the current key.
+func (c *Conn) ReadSig() ([]byte, error) {
+	if c.hr == nil {
+		return nil, ErrProto
+	}
+	size := KeySize
+	if c.peer != nil {
+		size = ed25519.SignatureSize
+	}
+	sig := make([]byte, size)
+	if _, err := io.ReadFull(c.r, sig); err != nil {
+		return nil, err
+	}
+	return sig, nil
+}
+
+// VerifySig checks sig against the hash of data read and resets the
+// hash.  ErrSig is returned on mismatch.  To try several keys, call
+// SetKey and WriteToHash before each VerifySig.
+func (c *Conn) VerifySig(sig []byte) error {
+	if c.hr == nil {
+		return ErrProto
+	}
+	c.hr.Write(c.chalThem)
+	c.hr.Write(c.seq(&c.nr))
+	sum := c.hr.Sum(nil)
+	c.hr.Reset()
+	if c.peer != nil {
+		if !ed25519.Verify(c.peer, sum, sig) {
+			return ErrSig
+		}
+	} else if !hmac.Equal(sig, sum) {
 		return ErrSig
 	}
 	return nil
 }
 
+// keyPad returns the pad that a new shared key is XORed with, derived
+// from the old key and both challenges of the connection.
+func keyPad(old, chalS, chalC []byte) []byte {
+	h := hmac.New(sha256.New, old)
+	h.Write([]byte("bench-gossip key\x00"))
+	h.Write(chalS)
+	h.Write(chalC)
+	return h.Sum(nil)
+}
+
+func xorKey(key, pad []byte) ([]byte, error) {
+	if len(key) != KeySize {
+		return nil, ErrKeySize
+	}
+	for i := range pad {
+		pad[i] ^= key[i]
+	}
+	return pad, nil
+}
+
+// SealKey encrypts a new shared key on the server side, so that only
+// the node, which knows the old key, can open it.  Both challenges
+// must have been exchanged.
+func (c *Conn) SealKey(old, key []byte) ([]byte, error) {
+	return xorKey(key, keyPad(old, c.chalThem, c.chalUs))
+}
+
+// OpenKey decrypts on the node side a key sealed by SealKey.
+func (c *Conn) OpenKey(old, sealed []byte) ([]byte, error) {
+	return xorKey(sealed, keyPad(old, c.chalUs, c.chalThem))
+}
+
 // SendChallenge generates a random challenge, appends it to buf
 // and sends the resulting buf to the network.
 func (c *Conn) SendChallenge(buf []byte) error {
@@ -198,10 +403,47 @@ func (c *Conn) SetKey(key []byte) error {
 	if len(key) != KeySize {
 		return ErrKeySize
 	}
-	c.h = hmac.New(sha256.New, key)
+	c.hr, c.hw = hmac.New(sha256.New, key), hmac.New(sha256.New, key)
+	c.priv, c.peer = nil, nil
 	return nil
 }
 
+// SetKeyPair switches c to public key mode, where messages are signed
+// with our private key priv and verified with their public key peer.
+func (c *Conn) SetKeyPair(priv ed25519.PrivateKey, peer ed25519.PublicKey) error {
+	if len(priv) != ed25519.PrivateKeySize ||
+		len(peer) != ed25519.PublicKeySize {
+		return ErrKeySize
+	}
+	c.hr, c.hw = sha256.New(), sha256.New()
+	c.priv, c.peer = priv, peer
+	return nil
+}
+
+// Stream switches c to stream mode, where messages may be sent at
+// any time and signatures cover sequence numbers.  Call it after
+// both sides have agreed to stream and the last message of the
+// ordinary exchange has been signed.
+func (c *Conn) Stream() {
+	c.stream = true
+}
+
+// SetDeadline sets the deadline for reading from and writing to the
+// network.
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.c.SetDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for reading from the network.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.c.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline for writing to the network.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.c.SetWriteDeadline(t)
+}
+
 // New wraps net.Conn and returns *Conn.
 // You may want to call SetKey() later.
 func New(nc net.Conn) (*Conn, error) {
@@ -212,17 +454,79 @@ func New(nc net.Conn) (*Conn, error) {
 	return &Conn{c: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}, nil
 }
 
-// Dial calls net.Dial to establish the connection and creates a hash from key.
+// Dial calls net.Dial to establish the connection and creates a hash
+// from key.  If key is nil, call SetKey or SetKeyPair later.
 func Dial(af, addr string, key []byte) (*Conn, error) {
 	nc, err := net.Dial(af, addr)
 	if err != nil {
 		return nil, err
 	}
+	return wrap(nc, key)
+}
+
+// DialTLS is like Dial, but establishes a TLS connection using config.
+func DialTLS(af, addr string, key []byte, config *tls.Config) (*Conn, error) {
+	nc, err := tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Minute},
+		af, addr, config)
+	if err != nil {
+		return nil, err
+	}
+	return wrap(nc, key)
+}
+
+// DialFunc connects to addr on network, like net.Dial.
+type DialFunc func(network, addr string) (net.Conn, error)
+
+// DialVia is like Dial, but connects using dial, for example through
+// a Proxy.  If config is not nil, it establishes a TLS connection.
+func DialVia(dial DialFunc, af, addr string, key []byte, config *tls.Config) (*Conn, error) {
+	nc, err := dial(af, addr)
+	if err != nil {
+		return nil, err
+	}
+	if config != nil {
+		nc.SetDeadline(time.Now().Add(10 * time.Minute))
+		tc := tls.Client(nc, config)
+		if err = tc.Handshake(); err != nil {
+			nc.Close()
+			return nil, err
+		}
+		nc = tc
+	}
+	return wrap(nc, key)
+}
+
+// Fingerprint returns the SHA-256 hash of a DER-encoded certificate.
+func Fingerprint(cert []byte) []byte {
+	sum := sha256.Sum256(cert)
+	return sum[:]
+}
+
+// PinnedConfig returns TLS configuration for connecting to a server
+// whose certificate has the SHA-256 fingerprint fp.  Other certificates
+// are rejected, whoever signed them.
+func PinnedConfig(fp []byte) *tls.Config {
+	return &tls.Config{
+		InsecureSkipVerify: true, // checked below
+		VerifyPeerCertificate: func(certs [][]byte, _ [][]*x509.Certificate) error {
+			if len(certs) == 0 || !bytes.Equal(Fingerprint(certs[0]), fp) {
+				return ErrCert
+			}
+			return nil
+		},
+	}
+}
+
+// wrap creates a Conn from nc and a hash from key, if not nil.
+func wrap(nc net.Conn, key []byte) (*Conn, error) {
 	c, err := New(nc)
 	if err != nil {
 		nc.Close()
 		return nil, err
 	}
+	if key == nil {
+		return c, nil
+	}
 	if err = c.SetKey(key); err != nil {
 		nc.Close()
 		return nil, err
@@ -0,0 +1,315 @@
+// Benchnet
+//
+// Copyright 2012 Vadim Vygonets
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conn
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testLog records messages logged.
+type testLog struct {
+	mu  sync.Mutex
+	msg []string
+}
+
+func (l *testLog) log(m string) error {
+	l.mu.Lock()
+	l.msg = append(l.msg, m)
+	l.mu.Unlock()
+	return nil
+}
+
+func (l *testLog) Debug(m string) error  { return l.log(m) }
+func (l *testLog) Info(m string) error   { return l.log(m) }
+func (l *testLog) Notice(m string) error { return l.log(m) }
+func (l *testLog) Err(m string) error    { return l.log(m) }
+
+// has checks if a message containing s was logged.
+func (l *testLog) has(s string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, m := range l.msg {
+		if strings.Contains(m, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// testServer is the server's JobSource and ResultSink for one node.
+// Results are stored durably as soon as they're added.
+type testServer struct {
+	mu      sync.Mutex
+	n       Node
+	setCaps int   // calls to SetCaps
+	batches []int // lengths of results added
+	results []Result
+}
+
+func (s *testServer) Node(id uint64) (*Node, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if id != s.n.NodeId {
+		return nil, fmt.Errorf("no node %d", id)
+	}
+	n := s.n
+	return &n, nil
+}
+
+func (s *testServer) SetCaps(id uint64, caps []string) error {
+	s.mu.Lock()
+	s.n.Caps = caps
+	s.setCaps++
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *testServer) Watch(id uint64, w chan bool)   {}
+func (s *testServer) Unwatch(id uint64, w chan bool) {}
+func (s *testServer) Interval(l []Job) time.Duration { return 0 }
+
+func (s *testServer) AddResults(id uint64, r []Result) {
+	if len(r) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batches = append(s.batches, len(r))
+	s.results = append(s.results, r...)
+	for _, v := range r {
+		if v.Seq > s.n.Acked {
+			s.n.Acked = v.Seq
+		}
+	}
+}
+
+func (s *testServer) Seen(id uint64, t uint64) {}
+
+// testNode is the node's ResultSource and JobSink.
+type testNode struct {
+	results []*Result
+	acks    []int64
+	jobs    []Job
+}
+
+func (n *testNode) ResultsSince(t uint64) ([]*Result, int64, error) {
+	var (
+		ra   []*Result
+		last int64
+	)
+	for _, r := range n.results {
+		if uint64(r.Start) >= t {
+			ra, last = append(ra, r), r.Seq
+		}
+	}
+	return ra, last, nil
+}
+
+func (n *testNode) ResultsAfter(seq int64, max int) ([]*Result, error) {
+	var ra []*Result
+	for _, r := range n.results {
+		if r.Seq > seq && (max <= 0 || len(ra) < max) {
+			ra = append(ra, r)
+		}
+	}
+	return ra, nil
+}
+
+func (n *testNode) Ack(seq int64) error {
+	n.acks = append(n.acks, seq)
+	var ra []*Result
+	for _, r := range n.results {
+		if r.Seq > seq {
+			ra = append(ra, r)
+		}
+	}
+	n.results = ra
+	return nil
+}
+
+func (n *testNode) Expire(t uint64) error { return nil }
+
+func (n *testNode) SetJobs(l []Job) error {
+	n.jobs = l
+	return nil
+}
+
+var (
+	testKey  = bytes.Repeat([]byte{1}, KeySize)
+	testJobs = []Job{{Id: 9, Period: 60, Check: []string{"dns", "example.com"}}}
+)
+
+// newTest returns a server with node 5 of client 2 knowing keys, and
+// the node's client with n results, large enough to be compressed.
+func newTest(n int, keys ...Key) (*Server, *testServer, *Client, *testNode) {
+	ts := &testServer{n: Node{ClientId: 2, NodeId: 5, Keys: keys,
+		Jobs: testJobs}}
+	srv := NewServer(ts, ts)
+	srv.Lockout, srv.Log = nil, &testLog{}
+	tn := &testNode{}
+	for i := 1; i <= n; i++ {
+		tn.results = append(tn.results, &Result{JobId: 9,
+			Start: int64(i), Seq: int64(i),
+			S: []string{strings.Repeat("result ", 100)}})
+	}
+	return srv, ts, NewClient(2, 5, tn, tn), tn
+}
+
+// talk runs one connection of c to serve over a pipe, dialed with
+// key, and returns the error of c.
+func talk(serve func(net.Conn), c *Client, key []byte) error {
+	cn, sn := net.Pipe()
+	done := make(chan bool)
+	go func() {
+		serve(sn)
+		close(done)
+	}()
+	s, err := wrap(cn, key)
+	if err == nil {
+		err = c.Talk(s)
+		s.Close()
+	}
+	<-done
+	return err
+}
+
+func TestBatches(t *testing.T) {
+	srv, ts, c, tn := newTest(5, Key{Key: testKey})
+	srv.Limits.Batch = 2
+	if err := talk(srv.Serve, c, testKey); err != nil {
+		t.Fatal(err)
+	}
+	if c.agreed == nil || !batched(c.can) || !c.can(CapGzip) {
+		t.Errorf("agreed %v, want batches and gzip", c.agreed)
+	}
+	if ts.setCaps != 1 || !(&Hello{Caps: ts.n.Caps}).Has(CapBatch) {
+		t.Errorf("caps %v set %d times", ts.n.Caps, ts.setCaps)
+	}
+	if fmt.Sprint(ts.batches) != "[2 2 1]" || ts.n.Acked != 5 {
+		t.Errorf("batches %v acked %d, want [2 2 1] acked 5",
+			ts.batches, ts.n.Acked)
+	}
+	if !JobsEqual(tn.jobs, testJobs) {
+		t.Errorf("jobs %v, want %v", tn.jobs, testJobs)
+	}
+	if !srv.Log.(*testLog).has("ratio") {
+		t.Error("results not compressed")
+	}
+
+	// the next connection acknowledges and deletes the results
+	if err := talk(srv.Serve, c, testKey); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(tn.acks) != "[0 5]" || len(tn.results) != 0 ||
+		len(ts.batches) != 3 {
+		t.Errorf("acks %v, %d results left, %d batches",
+			tn.acks, len(tn.results), len(ts.batches))
+	}
+}
+
+func TestVersion0(t *testing.T) {
+	srv, ts, c, tn := newTest(3, Key{Key: testKey})
+	// a version 0 server takes the hello for the node id and closes
+	v0 := func(nc net.Conn) {
+		defer nc.Close()
+		s, err := New(nc)
+		if err == nil && s.SendChallenge([]byte(Greet)) == nil {
+			io.ReadFull(s, make([]byte, 16))
+		}
+	}
+	if err := talk(v0, c, testKey); err == nil || !c.noHello {
+		t.Fatalf("talk to version 0: %v, noHello %v", err, c.noHello)
+	}
+	if err := talk(srv.Serve, c, testKey); err != nil {
+		t.Fatal(err)
+	}
+	if c.agreed != nil || ts.setCaps != 0 || ts.n.Caps != nil {
+		t.Errorf("agreed %v, caps %v set %d times, want version 0",
+			c.agreed, ts.n.Caps, ts.setCaps)
+	}
+	if fmt.Sprint(ts.batches) != "[3]" || len(tn.acks) != 0 {
+		t.Errorf("batches %v acks %v, want [3] without acks",
+			ts.batches, tn.acks)
+	}
+	if !JobsEqual(tn.jobs, testJobs) {
+		t.Errorf("jobs %v, want %v", tn.jobs, testJobs)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	cn, sn := net.Pipe()
+	a, _ := New(cn)
+	b, _ := New(sn)
+	defer a.Close()
+	defer b.Close()
+	a.SetCompression(true)
+	b.SetCompression(true)
+	big := strings.Repeat("compressible ", 1000)
+	go func() {
+		for _, v := range []string{"small", big, big} {
+			a.Encode(v)
+		}
+		a.Flush()
+	}()
+	var s string
+	if err := b.Decode(&s); err != nil || s != "small" {
+		t.Fatalf("small: %q, %v", s, err)
+	}
+	if st := b.Stats(); st.Raw != st.Wire {
+		t.Errorf("small payload compressed: %+v", st)
+	}
+	if err := b.Decode(&s); err != nil || s != big {
+		t.Fatalf("big: %d bytes, %v", len(s), err)
+	}
+	if st := b.Stats(); st.Ratio() < 10 {
+		t.Errorf("big payload not compressed: %+v", st)
+	}
+	// the limit applies to the payload decompressed
+	if err := b.DecodeLimit(&s, 1000); err != ErrTooBig {
+		t.Errorf("decode over limit: %v, want %v", err, ErrTooBig)
+	}
+}
+
+func TestSigMismatch(t *testing.T) {
+	srv, _, c, _ := newTest(1, Key{Key: testKey})
+	if err := talk(srv.Serve, c, bytes.Repeat([]byte{2}, KeySize)); err == nil ||
+		c.Authenticated() {
+		t.Errorf("wrong shared key: %v, authenticated %v",
+			err, c.Authenticated())
+	}
+	if !srv.Log.(*testLog).has(ErrSig.Error()) {
+		t.Error("server didn't report signature mismatch")
+	}
+
+	// the node checks the server's signature with the wrong key
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	_, srvPriv, _ := ed25519.GenerateKey(nil)
+	wrong, _, _ := ed25519.GenerateKey(nil)
+	srv, _, c, _ = newTest(1, Key{Key: pub, Pub: true})
+	srv.Key, c.PrivKey, c.ServerKey = srvPriv, priv, wrong
+	if err := talk(srv.Serve, c, nil); err != ErrSig {
+		t.Errorf("wrong server key: %v, want %v", err, ErrSig)
+	}
+}
@@ -0,0 +1,151 @@
+// Benchnet
+//
+// Copyright 2012 Vadim Vygonets
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conn
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	Version    = 1               // highest protocol version implemented
+	HelloMagic = "bench-gossip-" // start of the hello line
+	maxHello   = 4096            // maximum length of the hello line
+)
+
+// Capabilities.  Supported checks are advertised by the node as
+// CapCheck followed by the check path joined with dots, for example
+// "check:http.get".
+const (
+	CapStream = "stream" // persistent stream mode
+	CapOnce   = "once"   // one-shot jobs
+	CapAck    = "ack"    // results acknowledged by sequence number
+	CapBatch  = "batch"  // results sent in limited batches, needs CapAck
+	CapGzip   = "gzip"   // compressed payloads, see Encode
+	CapClock  = "clock"  // server's time sent with cursor, needs CapAck
+	CapCheck  = "check:"
+)
+
+// Hello is the version and capability line, sent by the node right
+// after the greeting and answered by the server:
+//
+//	bench-gossip-<version> <capability>...\n
+type Hello struct {
+	Version int
+	Caps    []string
+}
+
+func (h *Hello) String() string {
+	return HelloMagic + strconv.Itoa(h.Version) + " " +
+		strings.Join(h.Caps, " ") + "\n"
+}
+
+// Has checks if h advertises capability c.
+func (h *Hello) Has(c string) bool {
+	for _, v := range h.Caps {
+		if v == c {
+			return true
+		}
+	}
+	return false
+}
+
+// batched checks, with can telling if the peer has a capability, if
+// results are sent in batches.  Both sides must agree on it.
+func batched(can func(string) bool) bool {
+	return can(CapAck) && can(CapBatch)
+}
+
+// Agree returns the highest version common to h and them and the
+// capabilities both of them have.
+func (h *Hello) Agree(them *Hello) *Hello {
+	a := &Hello{Version: h.Version}
+	if them.Version < a.Version {
+		a.Version = them.Version
+	}
+	for _, v := range h.Caps {
+		if them.Has(v) {
+			a.Caps = append(a.Caps, v)
+		}
+	}
+	return a
+}
+
+// ParseHello parses the hello line s, including the newline.
+func ParseHello(s string) (*Hello, error) {
+	f := strings.Fields(s)
+	if !strings.HasSuffix(s, "\n") || len(f) == 0 ||
+		!strings.HasPrefix(f[0], HelloMagic) {
+		return nil, ErrProto
+	}
+	v, err := strconv.Atoi(f[0][len(HelloMagic):])
+	if err != nil || v < 1 {
+		return nil, ErrProto
+	}
+	caps := f[1:]
+	sort.Strings(caps)
+	return &Hello{Version: v, Caps: caps}, nil
+}
+
+// IsHello checks if buf, the first bytes received from the node,
+// start a hello line rather than the node id.
+func IsHello(buf []byte) bool {
+	return bytes.HasPrefix(buf, []byte(HelloMagic))
+}
+
+// SendHello sends hello line h.  The line is not hashed as it's sent,
+// but remembered, see Hellos.
+func (c *Conn) SendHello(h *Hello) error {
+	s := h.String()
+	if _, err := c.w.WriteString(s); err != nil {
+		return err
+	}
+	c.hellos = append(c.hellos, s...)
+	return c.w.Flush()
+}
+
+// ReadHello reads a hello line, the beginning of which, if any, has
+// already been read into prefix.
+func (c *Conn) ReadHello(prefix []byte) (*Hello, error) {
+	buf := append([]byte{}, prefix...)
+	for len(buf) == 0 || buf[len(buf)-1] != '\n' {
+		if len(buf) >= maxHello {
+			return nil, ErrProto
+		}
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, b)
+	}
+	h, err := ParseHello(string(buf))
+	if err != nil {
+		return nil, fmt.Errorf("invalid hello %q", buf)
+	}
+	c.hellos = append(c.hellos, buf...)
+	return h, nil
+}
+
+// Hellos returns the hello lines exchanged so far, the node's first.
+// Both sides sign them along with the node id, so that nobody can
+// tamper with the negotiation.
+func (c *Conn) Hellos() []byte {
+	return c.hellos
+}
@@ -0,0 +1,274 @@
+// Benchnet
+//
+// Copyright 2012 Vadim Vygonets
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conn
+
+import (
+	"errors"
+	"fmt"
+	"github.com/unixdj/benchnet/lib/clock"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrLocked = errors.New("locked out after failed authentication")
+	ErrBusy   = errors.New("too many connections authenticating")
+)
+
+// Lockout keeps the server from talking to hosts and nodes that keep
+// failing to authenticate.  After Free consecutive failures, a host or
+// a node is locked out for Base, then for twice as long after each
+// further failure, up to Max for hosts and MaxNode for nodes.  Node
+// lockouts are kept short, since anyone can cause them.  Counters are
+// reset when the host or the node authenticates, and forgotten a day
+// after the last lockout ends.
+//
+// Lockout also limits the number of connections that haven't
+// authenticated yet to MaxUnauth, if positive.
+type Lockout struct {
+	Free         int
+	Base         time.Duration
+	Max, MaxNode time.Duration
+	MaxUnauth    int
+	Clock        clock.Clock
+
+	mu      sync.Mutex
+	hosts   map[string]*failures
+	nodes   map[uint64]*failures
+	unauth  int       // connections authenticating
+	refused uint64    // connections refused
+	pruned  time.Time // last time counters were forgotten
+}
+
+// failures counts consecutive authentication failures.
+type failures struct {
+	count int       // failures in a row
+	last  time.Time // time of the last one
+	until time.Time // locked out until
+}
+
+// Failures describes failures of a host or a node, see Lockout.Hosts
+// and Lockout.Nodes.
+type Failures struct {
+	Host   string // host address, for hosts
+	NodeId uint64 // node id, for nodes
+	Count  int    // failures in a row
+	Last   time.Time
+	Until  time.Time // locked out until, zero if never
+}
+
+func (f *Failures) String() string {
+	s := fmt.Sprintf("node %d", f.NodeId)
+	if f.Host != "" {
+		s = "host " + f.Host
+	}
+	s += fmt.Sprintf(" failures %d last %s", f.Count,
+		f.Last.UTC().Format(time.RFC3339))
+	if !f.Until.IsZero() {
+		s += " locked until " + f.Until.UTC().Format(time.RFC3339)
+	}
+	return s
+}
+
+// forget is how long counters are kept after the last lockout ends.
+const forget = 24 * time.Hour
+
+// NewLockout returns a Lockout with default limits.
+func NewLockout() *Lockout {
+	return &Lockout{
+		Free:      5,
+		Base:      time.Minute,
+		Max:       24 * time.Hour,
+		MaxNode:   15 * time.Minute,
+		MaxUnauth: 256,
+		Clock:     clock.Real,
+		hosts:     make(map[string]*failures),
+		nodes:     make(map[uint64]*failures),
+	}
+}
+
+// hostOf returns the host part of addr.
+func hostOf(addr net.Addr) string {
+	s := addr.String()
+	if h, _, err := net.SplitHostPort(s); err == nil {
+		return h
+	}
+	return s
+}
+
+// locked checks if f is locked out at now.
+func (f *failures) locked(now time.Time) bool {
+	return f != nil && now.Before(f.until)
+}
+
+// fail counts a failure at now and locks f out if it has failed too
+// often, for no longer than max.
+func (l *Lockout) fail(f *failures, now time.Time, max time.Duration) {
+	f.count++
+	f.last = now
+	if n := f.count - l.Free; n > 0 {
+		d := max
+		if n <= 32 && l.Base<<uint(n-1) < max {
+			d = l.Base << uint(n-1)
+		}
+		f.until = now.Add(d)
+	}
+}
+
+// prune forgets counters that are no longer interesting at now.
+// l.mu must be held.
+func (l *Lockout) prune(now time.Time) {
+	if now.Sub(l.pruned) < time.Minute {
+		return
+	}
+	l.pruned = now
+	old := now.Add(-forget)
+	for k, f := range l.hosts {
+		if f.last.Before(old) && f.until.Before(old) {
+			delete(l.hosts, k)
+		}
+	}
+	for k, f := range l.nodes {
+		if f.last.Before(old) && f.until.Before(old) {
+			delete(l.nodes, k)
+		}
+	}
+}
+
+// admit is called on a new connection from host.  If it returns nil,
+// release must be called once authentication ends.
+func (l *Lockout) admit(host string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.Clock.Now()
+	l.prune(now)
+	switch {
+	case l.hosts[host].locked(now):
+		l.refused++
+		return ErrLocked
+	case l.MaxUnauth > 0 && l.unauth >= l.MaxUnauth:
+		l.refused++
+		return ErrBusy
+	}
+	l.unauth++
+	return nil
+}
+
+// admitNode checks if node id may authenticate.
+func (l *Lockout) admitNode(id uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.nodes[id].locked(l.Clock.Now()) {
+		return ErrLocked
+	}
+	return nil
+}
+
+// release is called when authentication on an admitted connection
+// ends, whether it succeeded, failed or the connection broke.
+func (l *Lockout) release() {
+	l.mu.Lock()
+	l.unauth--
+	l.mu.Unlock()
+}
+
+// succeeded resets the counters of host and node id once the node
+// has authenticated from host.
+func (l *Lockout) succeeded(host string, id uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.hosts, host)
+	delete(l.nodes, id)
+}
+
+// failed counts a failure of host to authenticate, and of node id if
+// node is set, that is, if the host claimed to be an existing node.
+func (l *Lockout) failed(host string, id uint64, node bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.Clock.Now()
+	f := l.hosts[host]
+	if f == nil {
+		f = &failures{}
+		l.hosts[host] = f
+	}
+	l.fail(f, now, l.Max)
+	if !node {
+		return
+	}
+	if f = l.nodes[id]; f == nil {
+		f = &failures{}
+		l.nodes[id] = f
+	}
+	if !f.locked(now) { // don't let anyone extend the lockout
+		l.fail(f, now, l.MaxNode)
+	}
+}
+
+// Unauthenticated returns the number of connections authenticating
+// and the number of connections refused so far.
+func (l *Lockout) Unauthenticated() (n int, refused uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.unauth, l.refused
+}
+
+// Hosts returns failures of hosts, sorted by address.
+func (l *Lockout) Hosts() []Failures {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	a := make([]Failures, 0, len(l.hosts))
+	for k, f := range l.hosts {
+		a = append(a, Failures{Host: k, Count: f.count, Last: f.last,
+			Until: f.until})
+	}
+	sort.Slice(a, func(i, j int) bool { return a[i].Host < a[j].Host })
+	return a
+}
+
+// Nodes returns failures of nodes, sorted by id.
+func (l *Lockout) Nodes() []Failures {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	a := make([]Failures, 0, len(l.nodes))
+	for k, f := range l.nodes {
+		a = append(a, Failures{NodeId: k, Count: f.count, Last: f.last,
+			Until: f.until})
+	}
+	sort.Slice(a, func(i, j int) bool { return a[i].NodeId < a[j].NodeId })
+	return a
+}
+
+// ClearHost forgets failures of host, and reports if there were any.
+func (l *Lockout) ClearHost(host string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.hosts[host]
+	delete(l.hosts, host)
+	return ok
+}
+
+// ClearNode forgets failures of node id, and reports if there were any.
+func (l *Lockout) ClearNode(id uint64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.nodes[id]
+	delete(l.nodes, id)
+	return ok
+}
@@ -0,0 +1,120 @@
+// Benchnet
+//
+// Copyright 2012 Vadim Vygonets
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conn
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// Job describes a job as the server sends it to the node.  Jobs with
+// zero Period are one-shot jobs.  They run once at Unix time Start,
+// or as soon as received if Start is zero or has passed.
+type Job struct {
+	Id            uint64
+	Period, Start int // seconds
+	Check         []string
+	Overrun       int // overrun policy, see benchnode/sched
+}
+
+// Flags for Result, same as in benchnode/check
+const (
+	ResFail = 1 << iota // Check failed
+)
+
+// Result is the result of a check as the node sends it to the server.
+type Result struct {
+	JobId uint64   // Id of job that started the check
+	Flags int      // Flags (failure)
+	Start int64    // Time the check ran, nanoseconds since Unix epoch
+	RT    int64    // Run Time of the check, nanoseconds
+	Errs  string   // Error string returned by libraries
+	S     []string // Results of the run (e.g., HTTP headers)
+	Delay int64    // Time the check waited to be run, nanoseconds
+	Seq   int64    // Sequence number on the node, 0 if none
+	Skew  int64    // Node's clock minus server's when sent, ns, 0 if unknown
+}
+
+// Logger receives messages about the progress of the protocol.
+// *syslog.Writer implements it.
+type Logger interface {
+	Debug(m string) error
+	Info(m string) error
+	Notice(m string) error
+	Err(m string) error
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string) error  { return nil }
+func (nopLogger) Info(string) error   { return nil }
+func (nopLogger) Notice(string) error { return nil }
+func (nopLogger) Err(string) error    { return nil }
+
+var ErrKilled = errors.New("killed")
+
+// Clock skew worth complaining about
+const MaxSkew = time.Minute
+
+type (
+	// extended bye
+	byeMsg struct {
+		Stream bool // node wants to stay connected
+	}
+	byeReply struct {
+		Stream   bool   // server agrees to stream
+		Interval int64  // suggested time till next connection, ns
+		Key      []byte // new shared key, sealed with the old one
+	}
+)
+
+// Read limits on payloads other than results, see Conn.DecodeLimit
+const (
+	maxMsg  = 4 << 10  // bye, bye reply and acknowledgement
+	maxJobs = 16 << 20 // job list
+)
+
+// JobsEqual checks if job lists l and m are the same.
+func JobsEqual(l, m []Job) bool {
+	if len(l) != len(m) {
+		return false
+	}
+	for i := range l {
+		a, b := &l[i], &m[i]
+		if a.Id != b.Id || a.Period != b.Period || a.Start != b.Start ||
+			a.Overrun != b.Overrun || strings.Join(a.Check, " ") !=
+			strings.Join(b.Check, " ") {
+			return false
+		}
+	}
+	return true
+}
+
+// sendMsg sends a stream message of type t with payload v, if any.
+func (c *Conn) sendMsg(t byte, v interface{}) error {
+	c.SetWriteDeadline(time.Now().Add(PingInterval))
+	if _, err := c.Write([]byte{t}); err != nil {
+		return err
+	}
+	if v != nil {
+		if err := c.Encode(v); err != nil {
+			return err
+		}
+	}
+	return c.SendSig()
+}
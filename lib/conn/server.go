@@ -0,0 +1,578 @@
+// Benchnet
+//
+// Copyright 2012 Vadim Vygonets
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conn
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"fmt"
+	"github.com/unixdj/benchnet/lib/clock"
+	"io"
+	"net"
+	"time"
+)
+
+// Key is a key a node may authenticate with.
+type Key struct {
+	Key []byte // shared key, or Ed25519 public key if Pub
+	Pub bool
+}
+
+// Node is what the server knows about a node.  A node authenticates
+// only with the id of the client owning it.
+type Node struct {
+	ClientId, NodeId uint64
+	LastSeen         uint64   // last connection, ns since Unix epoch
+	Keys             []Key    // keys valid now, newest first
+	Caps             []string // capabilities, sorted; nil for version 0
+	Acked            int64    // highest seq of results stored
+	Jobs             []Job    // jobs the node should run, sorted by id
+}
+
+// JobSource tells the server about nodes and the jobs they should run.
+type JobSource interface {
+	// Node returns node id, or an error if there's no such node.
+	Node(id uint64) (*Node, error)
+	// SetCaps sets the capabilities of node id, which has changed
+	// since the last connection.
+	SetCaps(id uint64, caps []string) error
+	// Watch makes the source notify w without blocking when the job
+	// list or Acked of node id changes, until Unwatch is called.
+	Watch(id uint64, w chan bool)
+	Unwatch(id uint64, w chan bool)
+	// Interval returns the reconnection interval to suggest to a node
+	// with job list l, 0 for no suggestion.
+	Interval(l []Job) time.Duration
+}
+
+// ResultSink stores results received from nodes.  Once it stores
+// them durably, it should raise Acked of the node and notify the
+// watcher.
+type ResultSink interface {
+	// AddResults adds results r of node id.
+	AddResults(id uint64, r []Result)
+	// Seen records that node id connected at t, ns since Unix epoch.
+	Seen(id uint64, t uint64)
+}
+
+// Limits on results received from a node
+type Limits struct {
+	Batch       int   // results in a batch
+	BatchBytes  int   // size of an encoded batch
+	Upload      int   // results in batches in a connection
+	LegacyBytes int64 // size of results from nodes not batching
+}
+
+var DefaultLimits = Limits{
+	Batch:       256,
+	BatchBytes:  1 << 20,
+	Upload:      10000,
+	LegacyBytes: 64 << 20,
+}
+
+// Server is the server side of the protocol.
+type Server struct {
+	Key         ed25519.PrivateKey // for nodes with Ed25519 keys
+	Nodes       JobSource
+	Results     ResultSink
+	Limits      Limits
+	Lockout     *Lockout      // limits failed authentication, if set
+	AuthTimeout time.Duration // time to authenticate, if positive
+	Log         Logger
+	Clock       clock.Clock
+}
+
+// Deadline for connections once authenticated, as set by New
+const sessionTimeout = 10 * time.Minute
+
+// NewServer returns a Server with default limits and lockout, getting
+// nodes and jobs from j and storing results in r.
+func NewServer(j JobSource, r ResultSink) *Server {
+	return &Server{
+		Nodes:       j,
+		Results:     r,
+		Limits:      DefaultLimits,
+		Lockout:     NewLockout(),
+		AuthTimeout: time.Minute,
+		Log:         nopLogger{},
+		Clock:       clock.Real,
+	}
+}
+
+// serverConn is the state of one connection.
+type serverConn struct {
+	*Server
+	c      *Conn
+	client string   // for logging
+	host   string   // for Lockout
+	authed bool     // node authenticated
+	n      *Node    // the node, once known
+	r      []Result // results received, if not in batches
+	stream bool     // node stays connected
+	hello  *Hello   // node's hello, nil for version 0
+	total  int      // results received in batches
+	key    []byte   // shared key the node authenticated with
+	newKey []byte   // newer shared key to send to the node
+}
+
+type serverStep func() (serverStep, error)
+
+func (d *serverConn) sendGreet() (serverStep, error) {
+	greets := make([]byte, len(Greet))
+	copy(greets, Greet)
+	return d.authClient, d.c.SendChallenge(greets)
+}
+
+func (d *serverConn) authClient() (serverStep, error) {
+	c := d.c
+	var buf [16]byte
+	_, err := io.ReadFull(c, buf[:])
+	if err != nil {
+		return nil, err
+	}
+	if IsHello(buf[:]) {
+		if d.hello != nil {
+			return nil, ErrProto
+		}
+		if d.hello, err = c.ReadHello(buf[:]); err != nil {
+			return nil, err
+		}
+		us := &Hello{
+			Version: Version,
+			Caps: []string{CapAck, CapBatch, CapClock, CapGzip, CapOnce,
+				CapStream},
+		}
+		if err = c.SendHello(us); err != nil {
+			return nil, err
+		}
+		c.SetCompression(d.hello.Has(CapGzip))
+		return d.authClient, nil
+	}
+	clientId := binary.BigEndian.Uint64(buf[:8])
+	id := binary.BigEndian.Uint64(buf[8:])
+	if d.n, err = d.Nodes.Node(id); err != nil {
+		return nil, err
+	}
+	if d.Lockout != nil {
+		if err = d.Lockout.admitNode(id); err != nil {
+			return nil, err
+		}
+	}
+	keys := d.n.Keys
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("node %d has no valid key", id)
+	}
+	// the newest key determines the signature size
+	if err = d.setKey(&keys[0]); err != nil {
+		return nil, err
+	}
+	sig, err := c.ReadSig()
+	if err != nil {
+		return nil, err
+	}
+	err = ErrSig
+	for i := range keys {
+		k := &keys[i]
+		if k.Pub != keys[0].Pub {
+			continue
+		}
+		if err = d.setKey(k); err != nil {
+			return nil, err
+		}
+		c.WriteToHash(c.Hellos())
+		c.WriteToHash(buf[:])
+		if err = c.VerifySig(sig); err == nil {
+			if i != 0 && !k.Pub {
+				d.key, d.newKey = k.Key, keys[0].Key
+			}
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if clientId != d.n.ClientId {
+		return nil, fmt.Errorf("node %d does not belong to client %d",
+			id, clientId)
+	}
+	d.authed = true
+	if d.Lockout != nil {
+		d.Lockout.release()
+		d.Lockout.succeeded(d.host, id)
+	}
+	c.SetDeadline(time.Now().Add(sessionTimeout))
+	d.Log.Info(fmt.Sprintf("%s: authenticated node %d of client %d",
+		d.client, id, clientId))
+	var caps []string
+	if d.hello != nil {
+		caps = d.hello.Caps
+		d.Log.Debug(fmt.Sprintf("%s: version %d, capabilities %v",
+			d.client, d.hello.Version, caps))
+	}
+	if !capsEqual(caps, d.n.Caps) {
+		if err = d.Nodes.SetCaps(id, caps); err != nil {
+			return nil, err
+		}
+		if d.n, err = d.Nodes.Node(id); err != nil {
+			return nil, err
+		}
+	}
+	return d.recvLogs, c.ReceiveChallenge()
+}
+
+// capsEqual checks if capability lists a and b are the same.
+func capsEqual(a, b []string) bool {
+	if len(a) != len(b) || (a == nil) != (b == nil) {
+		return false
+	}
+	for i, v := range a {
+		if v != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// setKey sets the key of the connection to the node key k.
+func (d *serverConn) setKey(k *Key) error {
+	if k.Pub {
+		return d.c.SetKeyPair(d.Key, ed25519.PublicKey(k.Key))
+	}
+	return d.c.SetKey(k.Key)
+}
+
+// can checks if the node has capability v.
+func (d *serverConn) can(v string) bool {
+	return d.hello != nil && d.hello.Has(v)
+}
+
+// decodeResults decodes results within the limits.
+func (d *serverConn) decodeResults(batched bool) ([]Result, error) {
+	var r []Result
+	limit := d.Limits.LegacyBytes
+	if batched {
+		limit = int64(d.Limits.BatchBytes)
+	}
+	if err := d.c.DecodeLimit(&r, limit); err != nil {
+		return nil, err
+	}
+	if batched && len(r) > d.Limits.Batch {
+		return nil, ErrTooBig
+	}
+	return r, nil
+}
+
+// dropRan returns l without one-shot jobs that have results in r.
+func dropRan(l []Job, r []Result) []Job {
+	t := make([]Job, 0, len(l))
+	for _, j := range l {
+		if j.Period == 0 {
+			ran := false
+			for _, v := range r {
+				if v.JobId == j.Id {
+					ran = true
+					break
+				}
+			}
+			if ran {
+				continue
+			}
+		}
+		t = append(t, j)
+	}
+	return t
+}
+
+func (d *serverConn) recvLogs() (serverStep, error) {
+	c := d.c
+	var buf [28]byte
+	if d.can(CapAck) {
+		binary.BigEndian.PutUint64(buf[:], uint64(d.n.Acked))
+	} else {
+		binary.BigEndian.PutUint64(buf[:], d.n.LastSeen)
+	}
+	l := 8
+	if batched(d.can) {
+		binary.BigEndian.PutUint32(buf[8:], uint32(d.Limits.Batch))
+		binary.BigEndian.PutUint32(buf[12:], uint32(d.Limits.BatchBytes))
+		binary.BigEndian.PutUint32(buf[16:], uint32(d.Limits.Upload))
+		l = 20
+	}
+	if d.can(CapAck) && d.can(CapClock) {
+		binary.BigEndian.PutUint64(buf[l:], uint64(d.Clock.Now().UnixNano()))
+		l += 8
+	}
+	_, err := c.Write(buf[:l])
+	if err != nil {
+		return nil, err
+	}
+	if err = c.SendSig(); err != nil {
+		return nil, err
+	}
+	d.n.LastSeen = uint64(d.Clock.Now().UnixNano())
+	if batched(d.can) {
+		return d.recvBatch, nil
+	}
+	if d.r, err = d.decodeResults(false); err != nil {
+		return nil, err
+	}
+	d.n.Jobs = dropRan(d.n.Jobs, d.r)
+	return d.sendJobs, c.CheckSig()
+}
+
+// recvBatch receives a batch of results and adds them at once, so
+// that they're kept even if the connection breaks.  An empty batch
+// ends the logs.
+func (d *serverConn) recvBatch() (serverStep, error) {
+	d.c.SetDeadline(time.Now().Add(batchTimeout))
+	r, err := d.decodeResults(true)
+	if err != nil {
+		return nil, err
+	}
+	if err = d.c.CheckSig(); err != nil {
+		return nil, err
+	}
+	if len(r) == 0 {
+		return d.sendJobs, nil
+	}
+	if d.total += len(r); d.total > d.Limits.Upload {
+		return nil, ErrTooBig
+	}
+	d.n.Jobs = dropRan(d.n.Jobs, r)
+	d.Results.AddResults(d.n.NodeId, r)
+	return d.recvBatch, nil
+}
+
+func (d *serverConn) sendJobs() (serverStep, error) {
+	if err := d.c.Encode(d.n.Jobs); err != nil {
+		return nil, err
+	}
+	return d.recvBye, d.c.SendSig()
+}
+
+func (d *serverConn) recvBye() (serverStep, error) {
+	b, err := d.c.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch b {
+	case 0:
+		return nil, d.c.CheckSig()
+	case ByeExt:
+		return d.recvByeExt, nil
+	}
+	return nil, ErrProto
+}
+
+func (d *serverConn) recvByeExt() (serverStep, error) {
+	c := d.c
+	var m byeMsg
+	if err := c.DecodeLimit(&m, maxMsg); err != nil {
+		return nil, err
+	}
+	if err := c.CheckSig(); err != nil {
+		return nil, err
+	}
+	d.stream = m.Stream
+	r := byeReply{
+		Stream:   d.stream,
+		Interval: int64(d.Nodes.Interval(d.n.Jobs)),
+	}
+	if d.newKey != nil {
+		var err error
+		if r.Key, err = c.SealKey(d.key, d.newKey); err != nil {
+			return nil, err
+		}
+		d.Log.Info(fmt.Sprintf("%s: sending new key to node %d",
+			d.client, d.n.NodeId))
+	}
+	if err := c.Encode(r); err != nil {
+		return nil, err
+	}
+	return nil, c.SendSig()
+}
+
+// streamReader receives stream messages from the node and adds
+// results until an error occurs, which is sent to errc.
+func (d *serverConn) streamReader(errc chan<- error) {
+	c, id, batched := d.c, d.n.NodeId, batched(d.can)
+	for {
+		c.SetReadDeadline(time.Now().Add(3 * PingInterval))
+		t, err := c.ReadByte()
+		if err != nil {
+			errc <- err
+			return
+		}
+		var r []Result
+		switch t {
+		case MsgPing:
+		case MsgResults:
+			r, err = d.decodeResults(batched)
+		default:
+			err = ErrProto
+		}
+		if err == nil {
+			err = c.CheckSig()
+		}
+		if err != nil {
+			errc <- err
+			return
+		}
+		if len(r) != 0 {
+			d.Results.Seen(id, uint64(d.Clock.Now().UnixNano()))
+			d.Results.AddResults(id, r)
+		}
+	}
+}
+
+// serveStream keeps the connection with the node open, pushing its
+// job list whenever it changes, receiving results and acknowledging
+// them once stored.
+func (d *serverConn) serveStream() error {
+	c, id := d.c, d.n.NodeId
+	c.Stream()
+	var (
+		w     = make(chan bool, 1)
+		errc  = make(chan error, 1)
+		ping  = d.Clock.NewTicker(PingInterval)
+		sent  = d.n.Jobs
+		acked = d.n.Acked
+	)
+	d.Nodes.Watch(id, w)
+	w <- true // the list may have changed since it was sent
+	defer func() {
+		ping.Stop()
+		d.Nodes.Unwatch(id, w)
+	}()
+	go d.streamReader(errc)
+	for {
+		select {
+		case err := <-errc:
+			return err
+		case <-w:
+			n, err := d.Nodes.Node(id)
+			if err != nil {
+				return err
+			}
+			if !JobsEqual(n.Jobs, sent) {
+				if err := c.sendMsg(MsgJobs, n.Jobs); err != nil {
+					return err
+				}
+				sent = n.Jobs
+			}
+			if d.can(CapAck) && n.Acked > acked {
+				if err := c.sendMsg(MsgAck, n.Acked); err != nil {
+					return err
+				}
+				acked = n.Acked
+			}
+		case <-ping.C():
+			if err := c.sendMsg(MsgPing, nil); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// authFailed tells the lockout that authentication has ended with
+// err.  Errors of the network don't count as failures.
+func (d *serverConn) authFailed(err error) {
+	if d.Lockout == nil {
+		return
+	}
+	d.Lockout.release()
+	if _, ok := err.(net.Error); ok || err == nil || err == io.EOF ||
+		err == io.ErrUnexpectedEOF {
+		return
+	}
+	if d.n != nil {
+		d.Lockout.failed(d.host, d.n.NodeId, true)
+	} else {
+		d.Lockout.failed(d.host, 0, false)
+	}
+}
+
+// logRatio logs how well payloads received were compressed.
+func (d *serverConn) logRatio() {
+	if s := d.c.Stats(); s.Wire != 0 {
+		d.Log.Info(fmt.Sprintf("%s: received %d bytes as %d, ratio %.2f",
+			d.client, s.Raw, s.Wire, s.Ratio()))
+	}
+}
+
+// Serve talks to a node on nc and closes it when done.  If the node
+// asks to stream, Serve returns when the stream breaks.
+func (srv *Server) Serve(nc net.Conn) {
+	if srv.admit(nc) {
+		srv.serve(nc)
+	}
+}
+
+// admit asks the lockout, if any, whether the node on nc may try to
+// authenticate, and closes nc if not.  Once admitted, the lockout
+// must be released, as serve does.
+func (srv *Server) admit(nc net.Conn) bool {
+	if srv.Lockout == nil {
+		return true
+	}
+	if err := srv.Lockout.admit(hostOf(nc.RemoteAddr())); err != nil {
+		nc.Close()
+		srv.Log.Notice("client " + nc.RemoteAddr().String() +
+			": refused: " + err.Error())
+		return false
+	}
+	return true
+}
+
+// serve is Serve on an admitted connection.
+func (srv *Server) serve(nc net.Conn) {
+	client := "client " + nc.RemoteAddr().String()
+	host := hostOf(nc.RemoteAddr())
+	d := &serverConn{Server: srv, client: client, host: host}
+	c, err := New(nc)
+	if err != nil {
+		nc.Close()
+		d.authFailed(nil)
+		srv.Log.Notice(client + ": handle: " + err.Error())
+		return
+	}
+	defer c.Close()
+	d.c = c
+	defer d.logRatio()
+	if srv.AuthTimeout > 0 {
+		c.SetDeadline(time.Now().Add(srv.AuthTimeout))
+	}
+	f, err := d.sendGreet()
+	for f != nil && err == nil {
+		f, err = f()
+	}
+	if !d.authed {
+		d.authFailed(err)
+	}
+	if err != nil {
+		srv.Log.Notice(client + ": handle: " + err.Error())
+		return
+	}
+	srv.Log.Info(client + ": connection completed")
+	srv.Results.Seen(d.n.NodeId, d.n.LastSeen)
+	srv.Results.AddResults(d.n.NodeId, d.r)
+	if d.stream {
+		srv.Log.Info(client + ": streaming")
+		err = d.serveStream()
+		srv.Log.Info(client + ": stream closed: " + err.Error())
+	}
+}
@@ -0,0 +1,372 @@
+// Benchnet
+//
+// Copyright 2012 Vadim Vygonets
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package conn
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The protocol may also be carried in binary WebSocket messages
+// (RFC 6455) over TLS on WSPort, for networks where only HTTPS gets
+// through.  Only the framing differs.
+const (
+	WSPort     = ":443"
+	WSPath     = "/benchnet"
+	WSProtocol = "benchnet"
+)
+
+var ErrWS = errors.New("websocket handshake failed")
+
+// GUID from RFC 6455 for computing Sec-WebSocket-Accept
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes
+const (
+	wsCont   = 0
+	wsText   = 1
+	wsBinary = 2
+	wsClose  = 8
+	wsPing   = 9
+	wsPong   = 10
+)
+
+// Time to complete the handshake
+const wsTimeout = time.Minute
+
+// wsConn is a net.Conn carrying data in WebSocket binary messages.
+type wsConn struct {
+	net.Conn
+	r      *bufio.Reader
+	client bool       // mask frames sent, expect unmasked frames
+	wmu    sync.Mutex // serializes writing frames
+	closed bool       // close frame sent, under wmu
+	left   uint64     // unread payload of the current frame
+	mask   []byte     // masking key of the current frame, nil if none
+	pos    int        // offset into mask
+}
+
+func wsAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// hasToken checks if comma separated header h contains token.
+func hasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsClient performs the client side of the WebSocket handshake on nc
+// with server host.
+func wsClient(nc net.Conn, host string) (net.Conn, error) {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(buf[:])
+	nc.SetDeadline(time.Now().Add(wsTimeout))
+	_, err := io.WriteString(nc, "GET "+WSPath+" HTTP/1.1\r\n"+
+		"Host: "+host+"\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: "+key+"\r\n"+
+		"Sec-WebSocket-Version: 13\r\n"+
+		"Sec-WebSocket-Protocol: "+WSProtocol+"\r\n\r\n")
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(nc)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close() // 101 has no body
+	switch {
+	case resp.StatusCode != http.StatusSwitchingProtocols:
+		return nil, fmt.Errorf("%v: %s", ErrWS, resp.Status)
+	case !hasToken(resp.Header, "Upgrade", "websocket"),
+		!hasToken(resp.Header, "Connection", "upgrade"),
+		resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key),
+		resp.Header.Get("Sec-WebSocket-Protocol") != WSProtocol:
+		return nil, ErrWS
+	}
+	nc.SetDeadline(time.Time{})
+	return &wsConn{Conn: nc, r: r, client: true}, nil
+}
+
+// wsServer performs the server side of the WebSocket handshake on nc,
+// refusing requests for other paths or protocols.
+func wsServer(nc net.Conn) (net.Conn, error) {
+	nc.SetDeadline(time.Now().Add(wsTimeout))
+	r := bufio.NewReader(nc)
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	status := http.StatusBadRequest
+	switch {
+	case req.URL.Path != WSPath:
+		status = http.StatusNotFound
+	case req.Method != "GET":
+		status = http.StatusMethodNotAllowed
+	case !hasToken(req.Header, "Upgrade", "websocket"),
+		!hasToken(req.Header, "Connection", "upgrade"),
+		!hasToken(req.Header, "Sec-WebSocket-Protocol", WSProtocol),
+		key == "":
+	case req.Header.Get("Sec-WebSocket-Version") != "13":
+		status = http.StatusUpgradeRequired
+	default:
+		status = http.StatusSwitchingProtocols
+	}
+	if status != http.StatusSwitchingProtocols {
+		fmt.Fprintf(nc, "HTTP/1.1 %d %s\r\n"+
+			"Sec-WebSocket-Version: 13\r\n"+
+			"Content-Length: 0\r\nConnection: close\r\n\r\n",
+			status, http.StatusText(status))
+		return nil, fmt.Errorf("%v: %s %s: %d", ErrWS, req.Method,
+			req.URL.Path, status)
+	}
+	_, err = io.WriteString(nc, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: "+wsAccept(key)+"\r\n"+
+		"Sec-WebSocket-Protocol: "+WSProtocol+"\r\n\r\n")
+	if err != nil {
+		return nil, err
+	}
+	nc.SetDeadline(time.Time{})
+	return &wsConn{Conn: nc, r: r}, nil
+}
+
+// writeFrame sends a frame with opcode op and payload buf.
+func (c *wsConn) writeFrame(op byte, buf []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	if op == wsClose {
+		c.closed = true
+	}
+	hdr := make([]byte, 2, 14+len(buf))
+	hdr[0] = 0x80 | op // FIN
+	switch n := len(buf); {
+	case n < 126:
+		hdr[1] = byte(n)
+	case n <= 0xffff:
+		hdr[1] = 126
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(n))
+	default:
+		hdr[1] = 127
+		hdr = binary.BigEndian.AppendUint64(hdr, uint64(n))
+	}
+	if c.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		hdr[1] |= 0x80
+		hdr = append(hdr, mask[:]...)
+		for i, b := range buf {
+			hdr = append(hdr, b^mask[i&3])
+		}
+	} else {
+		hdr = append(hdr, buf...)
+	}
+	_, err := c.Conn.Write(hdr)
+	return err
+}
+
+// Write sends buf in a binary message.
+func (c *wsConn) Write(buf []byte) (int, error) {
+	if err := c.writeFrame(wsBinary, buf); err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+// readHeader reads a frame header, returning its opcode and setting
+// c.left and c.mask.
+func (c *wsConn) readHeader() (byte, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(c.r, hdr[:2]); err != nil {
+		return 0, err
+	}
+	op, fin, masked := hdr[0]&0xf, hdr[0]&0x80 != 0, hdr[1]&0x80 != 0
+	if hdr[0]&0x70 != 0 || masked == c.client {
+		return 0, ErrProto
+	}
+	switch c.left = uint64(hdr[1] & 0x7f); c.left {
+	case 126:
+		if _, err := io.ReadFull(c.r, hdr[:2]); err != nil {
+			return 0, err
+		}
+		c.left = uint64(binary.BigEndian.Uint16(hdr[:2]))
+	case 127:
+		if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+			return 0, err
+		}
+		c.left = binary.BigEndian.Uint64(hdr[:])
+	}
+	if op >= wsClose && (!fin || c.left > 125) {
+		return 0, ErrProto
+	}
+	c.mask, c.pos = nil, 0
+	if masked {
+		c.mask = make([]byte, 4)
+		if _, err := io.ReadFull(c.r, c.mask); err != nil {
+			return 0, err
+		}
+	}
+	return op, nil
+}
+
+// readPayload reads from the current frame into buf.
+func (c *wsConn) readPayload(buf []byte) (int, error) {
+	if uint64(len(buf)) > c.left {
+		buf = buf[:c.left]
+	}
+	n, err := c.r.Read(buf)
+	c.left -= uint64(n)
+	if c.mask != nil {
+		for i := range buf[:n] {
+			buf[i] ^= c.mask[c.pos&3]
+			c.pos++
+		}
+	}
+	return n, err
+}
+
+// Read reads data from binary messages, answering pings and closes.
+func (c *wsConn) Read(buf []byte) (int, error) {
+	for c.left == 0 {
+		op, err := c.readHeader()
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case wsCont, wsBinary:
+			continue
+		case wsClose, wsPing, wsPong:
+		default: // text or unknown
+			return 0, ErrProto
+		}
+		payload := make([]byte, c.left)
+		if _, err = io.ReadFull(readerFunc(c.readPayload), payload); err != nil {
+			return 0, err
+		}
+		switch op {
+		case wsPing:
+			err = c.writeFrame(wsPong, payload)
+		case wsClose:
+			c.writeFrame(wsClose, payload[:0])
+			err = io.EOF
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	return c.readPayload(buf)
+}
+
+// readerFunc is a function implementing io.Reader.
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(buf []byte) (int, error) { return f(buf) }
+
+// Close sends a close frame, unless one has been sent, and closes the
+// connection.
+func (c *wsConn) Close() error {
+	c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	c.writeFrame(wsClose, []byte{1000 >> 8, 1000 & 0xff}) // normal closure
+	return c.Conn.Close()
+}
+
+// DialWS connects to a server at addr, normally on WSPort, with dial
+// and config (nil for verifying the certificate against the system
+// roots) and sets up a WebSocket connection.  See Dial for key.
+func DialWS(dial DialFunc, addr string, key []byte, config *tls.Config) (*Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		config = &tls.Config{ServerName: host}
+	}
+	nc, err := dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	nc.SetDeadline(time.Now().Add(wsTimeout))
+	tc := tls.Client(nc, config)
+	if err = tc.Handshake(); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	if ":"+port != WSPort {
+		host = addr
+	}
+	ws, err := wsClient(tc, host)
+	if err != nil {
+		tc.Close()
+		return nil, err
+	}
+	return wrap(ws, key)
+}
+
+// ServeWS is like Serve, but sets up a WebSocket connection on nc
+// first, once the lockout admits the node.  nc is normally a TLS
+// connection.
+func (srv *Server) ServeWS(nc net.Conn) {
+	if !srv.admit(nc) {
+		return
+	}
+	ws, err := wsServer(nc)
+	if err != nil {
+		nc.Close()
+		if srv.Lockout != nil {
+			srv.Lockout.release()
+		}
+		srv.Log.Notice("client " + nc.RemoteAddr().String() +
+			": " + err.Error())
+		return
+	}
+	srv.serve(ws)
+}
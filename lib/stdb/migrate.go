@@ -0,0 +1,84 @@
+// Benchnet
+//
+// Copyright 2012 Vadim Vygonets
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stdb
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Migration upgrades a database schema by one version.
+type Migration struct {
+	Desc  string          // description for the log
+	Stmts []string        // statements to execute
+	Func  func(*Tx) error // run after Stmts, if not nil
+}
+
+const (
+	createVersion = "CREATE TABLE IF NOT EXISTS schema_version (version integer)"
+	selectVersion = "SELECT version FROM schema_version"
+	deleteVersion = "DELETE FROM schema_version"
+	insertVersion = "INSERT INTO schema_version (version) VALUES (?)"
+)
+
+// Migrate brings the schema up to version len(m).  Migration m[i]
+// upgrades version i to i+1; those not applied yet run in a single
+// transaction, and logf is called for each.  Migrate fails without
+// changes if the schema is newer than len(m).
+func (db *DB) Migrate(m []Migration, logf func(string) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nop if committed
+	if _, err = tx.Exec(createVersion); err != nil {
+		return err
+	}
+	var v int
+	err = tx.QueryRow(selectVersion).Scan(&v)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return err
+	case v > len(m):
+		return fmt.Errorf("schema version %d is newer than %d",
+			v, len(m))
+	}
+	if v == len(m) {
+		return tx.Commit()
+	}
+	for i := v; i < len(m); i++ {
+		logf(fmt.Sprintf("schema migration %d: %s", i+1, m[i].Desc))
+		for _, s := range m[i].Stmts {
+			if _, err = tx.Exec(s); err != nil {
+				return fmt.Errorf("migration %d: %v", i+1, err)
+			}
+		}
+		if m[i].Func != nil {
+			if err = m[i].Func(tx); err != nil {
+				return fmt.Errorf("migration %d: %v", i+1, err)
+			}
+		}
+	}
+	if _, err = tx.Exec(deleteVersion); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(insertVersion, len(m)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
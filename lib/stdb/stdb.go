@@ -23,7 +23,10 @@ gets requests and sends responses via channels, thus serializing
 database access.
 
 The API is like that of database/sql, except that some parts are
-missing.
+missing.  Queries use "?" placeholders, rewritten as "$1", "$2"...
+for the "postgres" driver.  Unsigned 64-bit integers, which
+database/sql refuses with the high bit set, are stored as signed
+ones with the same bits and converted back when scanned.
 
 After Begin() is called, the connection is locked onto the
 returned *Tx until either (*Tx).Commit() or (Tx).Rollback()
@@ -38,7 +41,11 @@ package stdb
 
 import (
 	"database/sql"
+	"database/sql/driver"
 	"errors"
+	"reflect"
+	"strconv"
+	"strings"
 )
 
 // operations
@@ -56,8 +63,9 @@ const (
 
 // DB is a database handle.
 type DB struct {
-	dbc *sql.DB  // backend
-	c   chan req // request channel
+	dbc    *sql.DB  // backend
+	c      chan req // request channel
+	dollar bool     // rewrite placeholders as $1, $2...
 }
 
 // Rows is the result of calling QueryRows.
@@ -97,9 +105,85 @@ type req struct {
 
 // thread
 
+// rebind rewrites "?" placeholders outside string literals in s as
+// "$1", "$2"... if needed.
+func (db *DB) rebind(s string) string {
+	if !db.dollar || !strings.Contains(s, "?") {
+		return s
+	}
+	var (
+		b      strings.Builder
+		n      int
+		quoted bool
+	)
+	for _, r := range s {
+		switch {
+		case r == '\'':
+			quoted = !quoted
+		case r == '?' && !quoted:
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// unsigned checks if k is an unsigned integer kind as wide as uint64.
+func unsigned(k reflect.Kind) bool {
+	return k == reflect.Uint64 || k == reflect.Uint && strconv.IntSize == 64
+}
+
+// bind returns args with unsigned 64-bit integers converted to int64.
+func bind(args []interface{}) []interface{} {
+	var a []interface{}
+	for i, v := range args {
+		if _, ok := v.(driver.Valuer); ok || v == nil ||
+			!unsigned(reflect.TypeOf(v).Kind()) {
+			continue
+		}
+		if a == nil {
+			a = append([]interface{}(nil), args...)
+		}
+		a[i] = int64(reflect.ValueOf(v).Uint())
+	}
+	if a == nil {
+		return args
+	}
+	return a
+}
+
+// scan calls f, Scan of sql.Rows or sql.Row, with dest, scanning
+// unsigned 64-bit integers stored by bind.
+func scan(f func(...interface{}) error, dest []interface{}) error {
+	d := dest
+	var set []func()
+	for i, v := range dest {
+		p := reflect.ValueOf(v)
+		if _, ok := v.(sql.Scanner); ok || p.Kind() != reflect.Ptr ||
+			p.IsNil() || !unsigned(p.Elem().Kind()) {
+			continue
+		}
+		if set == nil {
+			d = append([]interface{}(nil), dest...)
+		}
+		n := new(int64)
+		d[i] = n
+		set = append(set, func() { p.Elem().SetUint(uint64(*n)) })
+	}
+	if err := f(d...); err != nil {
+		return err
+	}
+	for _, f := range set {
+		f()
+	}
+	return nil
+}
+
 // Query loop: set up sql.Rows and loop until !Next() || Close() || input error
 func (db *DB) handleQuery(r *req) {
-	rows, err := db.dbc.Query(r.cmd, r.args...)
+	rows, err := db.dbc.Query(db.rebind(r.cmd), bind(r.args)...)
 	if err != nil {
 		r.c <- res{err: err}
 		return
@@ -111,7 +195,7 @@ func (db *DB) handleQuery(r *req) {
 		qr := <-rs.c
 		switch qr.op {
 		case opScan:
-			qr.c <- res{err: rows.Scan(qr.args...)}
+			qr.c <- res{err: scan(rows.Scan, qr.args)}
 		case opNext:
 			if rows.Next() {
 				qr.c <- res{}
@@ -133,15 +217,20 @@ func (db *DB) handleQuery(r *req) {
 	}
 }
 
+// queryRower is *sql.DB or *sql.Tx.
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
 // QueryRow loop: set up sql.Row and process one Scan()
-func (db *DB) handleQueryRow(r *req) {
-	row := db.dbc.QueryRow(r.cmd, r.args...)
+func (db *DB) handleQueryRow(q queryRower, r *req) {
+	row := q.QueryRow(db.rebind(r.cmd), bind(r.args)...)
 	rw := &Row{c: make(chan req)}
 	r.c <- res{rw: rw}
 	qr := <-rw.c
 	rw.closed = true
 	if qr.op == opScan {
-		qr.c <- res{err: row.Scan(qr.args...)}
+		qr.c <- res{err: scan(row.Scan, qr.args)}
 	} else {
 		qr.c <- res{err: errors.New("invalid db.Row operation")}
 	}
@@ -160,7 +249,7 @@ func (db *DB) handleTx(r *req) {
 		txr := <-ctx.c
 		switch txr.op {
 		case opExec:
-			result, err := tx.Exec(txr.cmd, txr.args...)
+			result, err := tx.Exec(db.rebind(txr.cmd), bind(txr.args)...)
 			txr.c <- res{result: result, err: err}
 		case opCommit:
 			ctx.closed = true
@@ -172,6 +261,8 @@ func (db *DB) handleTx(r *req) {
 			return
 		case opQuery:
 			db.handleQuery(&txr)
+		case opQueryRow:
+			db.handleQueryRow(tx, &txr)
 		default:
 			ctx.closed = true
 			txr.c <- res{err: errors.New("invalid db.Tx operation")}
@@ -196,12 +287,12 @@ func (db *DB) thread(driverName, dataSourceName string, c chan<- error) {
 			r.c <- res{err: db.dbc.Close()}
 			return
 		case opExec:
-			result, err := db.dbc.Exec(r.cmd, r.args...)
+			result, err := db.dbc.Exec(db.rebind(r.cmd), bind(r.args)...)
 			r.c <- res{result: result, err: err}
 		case opQuery:
 			db.handleQuery(&r)
 		case opQueryRow:
-			db.handleQueryRow(&r)
+			db.handleQueryRow(db.dbc, &r)
 		case opBegin:
 			db.handleTx(&r)
 		default:
@@ -214,7 +305,7 @@ func (db *DB) thread(driverName, dataSourceName string, c chan<- error) {
 
 // Open opens a database connection and starts the worker goroutine.
 func Open(driverName, dataSourceName string) (*DB, error) {
-	db := &DB{nil, make(chan req)}
+	db := &DB{nil, make(chan req), driverName == "postgres"}
 	c := make(chan error)
 	go db.thread(driverName, dataSourceName, c)
 	if err := <-c; err != nil {
@@ -314,6 +405,17 @@ func (tx *Tx) Exec(s string, args ...interface{}) (sql.Result, error) {
 	return r.result, r.err
 }
 
+// QueryRow executes a query that returns one row within the
+// transaction.
+func (tx *Tx) QueryRow(s string, args ...interface{}) *Row {
+	if tx.closed {
+		return &Row{closed: true}
+	}
+	c := make(chan res)
+	tx.c <- req{op: opQueryRow, cmd: s, args: args, c: c}
+	return (<-c).rw
+}
+
 func (tx *Tx) Commit() error {
 	if tx.closed {
 		return sql.ErrTxDone
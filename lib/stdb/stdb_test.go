@@ -0,0 +1,65 @@
+// Benchnet
+//
+// Copyright 2012 Vadim Vygonets
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stdb
+
+import "testing"
+
+var rebindTests = []struct {
+	in, out string
+}{
+	{"SELECT 1", "SELECT 1"},
+	{"DELETE FROM jobs WHERE id=?", "DELETE FROM jobs WHERE id=$1"},
+	{"INSERT INTO t VALUES (?, ?, ?)", "INSERT INTO t VALUES ($1, $2, $3)"},
+	{"SELECT '?' FROM t WHERE a=?", "SELECT '?' FROM t WHERE a=$1"},
+	{"SELECT 'it''s?', ? FROM t", "SELECT 'it''s?', $1 FROM t"},
+}
+
+func TestRebind(t *testing.T) {
+	for _, v := range rebindTests {
+		if s := (&DB{dollar: true}).rebind(v.in); s != v.out {
+			t.Errorf("rebind(%q) = %q, want %q", v.in, s, v.out)
+		}
+		if s := (&DB{}).rebind(v.in); s != v.in {
+			t.Errorf("rebind(%q) without dollar = %q", v.in, s)
+		}
+	}
+}
+
+type geoloc uint64
+
+func TestUnsigned(t *testing.T) {
+	args := []interface{}{uint64(1<<63 | 5), geoloc(7), "x", nil}
+	a := bind(args)
+	if a[0] != int64(-1<<63|5) || a[1] != int64(7) || a[2] != "x" ||
+		a[3] != nil || args[0] != uint64(1<<63|5) {
+		t.Errorf("bind(%v) = %v", args, a)
+	}
+	var (
+		id  uint64
+		loc geoloc
+		s   string
+	)
+	row := func(dest ...interface{}) error {
+		*dest[0].(*int64), *dest[1].(*int64) = -1<<63|5, 7
+		*dest[2].(*string) = "x"
+		return nil
+	}
+	if err := scan(row, []interface{}{&id, &loc, &s}); err != nil ||
+		id != 1<<63|5 || loc != 7 || s != "x" {
+		t.Errorf("scan: %v, %d, %d, %q", err, id, loc, s)
+	}
+}